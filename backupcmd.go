@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"./config"
+	"./filebackup"
+	"./store"
+)
+
+const backupUsage = `Usage: heis backup <list|inspect|restore> [flags]
+
+  list     lists all backup generations, newest first
+  inspect  prints the elevator stored in a generation
+  restore  makes a generation the newest, so it's used on the next start
+
+Only the file store keeps backup generations.
+`
+
+// backupCommand runs the backup subcommand with args, which are the arguments
+// after "backup". Returns the exit code.
+func backupCommand(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, backupUsage)
+		return 2
+	}
+
+	cfg := config.Default()
+	fs := flag.NewFlagSet("backup "+args[0], flag.ExitOnError)
+	configFile := fs.String("config", "", "JSON file the elevator reads its settings from, "+
+		"overridden by -port and -store")
+	port := fs.Int("port", cfg.Elevator.Port, "Port of the elevator whose backup to use")
+	backend := fs.String("store", cfg.Elevator.Store, "Store backend of the elevator")
+	gen := fs.Uint64("gen", 0, "Generation to inspect or restore")
+	fs.Parse(args[1:])
+
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load configuration: %v\n", err)
+			return 1
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Elevator.Port = *port
+		case "store":
+			cfg.Elevator.Store = *backend
+		}
+	})
+	if cfg.Elevator.Store != "file" {
+		fmt.Fprintf(os.Stderr, "The elevator uses the '%s' store, which has no backup "+
+			"generations. Only the 'file' store can be listed, inspected or restored.\n",
+			cfg.Elevator.Store)
+		return 1
+	}
+	fileName := filebackup.FileName(cfg.Elevator.Port)
+
+	switch args[0] {
+	case "list":
+		gens := filebackup.Generations(fileName)
+		if len(gens) == 0 {
+			fmt.Printf("No backups for '%s'\n", fileName)
+			return 0
+		}
+		for _, g := range gens {
+			status := "ok"
+			if g.Err != nil {
+				status = "INVALID: " + g.Err.Error()
+			}
+			fmt.Printf("%6d  %s  %.12s  %s\n", g.Number,
+				g.Timestamp.Format("2006-01-02 15:04:05.000"), g.Checksum, status)
+		}
+
+	case "inspect":
+		elev, err := filebackup.ReadGeneration(fileName, *gen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read generation %d: %v\n", *gen, err)
+			return 1
+		}
+		fmt.Println(elev.ToString())
+		fmt.Println(elev.OrderMatrixToString())
+		data, _ := json.MarshalIndent(elev, "", "  ")
+		fmt.Println(string(data))
+
+	case "restore":
+		if err := filebackup.NewWriter(fileName).Restore(*gen); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not restore: %v\n", err)
+			return 1
+		}
+		// the journal holds events on top of the newest generation, which
+		// don't apply to the restored one
+		journalFile := store.NewFile(fileName).JournalFile()
+		if err := os.Remove(journalFile); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Could not remove journal: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Restored generation %d of '%s'\n", *gen, fileName)
+
+	default:
+		fmt.Fprint(os.Stderr, backupUsage)
+		return 2
+	}
+	return 0
+}
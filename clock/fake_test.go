@@ -0,0 +1,106 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1000, 0)
+
+// fired returns the time c fired at, if it has.
+func fired(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeFiresInOrder(t *testing.T) {
+	clk := NewFake(start)
+	// created out of order
+	deadlines := []time.Duration{3 * time.Second, time.Second, 2 * time.Second}
+	var timers []Timer
+	for _, d := range deadlines {
+		timers = append(timers, clk.NewTimer(d))
+	}
+	after := clk.After(1500 * time.Millisecond)
+
+	// one timer at a time
+	for _, i := range []int{1, 2, 0} {
+		clk.Advance(time.Second)
+		for j, timer := range timers {
+			_, ok := fired(timer.C())
+			if ok != (j == i) {
+				t.Errorf("at %s timer %d fired: %v, want %v",
+					clk.Now().Sub(start), j, ok, j == i)
+			}
+		}
+	}
+	if at, ok := fired(after); !ok || !at.Equal(start.Add(1500*time.Millisecond)) {
+		t.Errorf("After fired at %v (%v), want 1.5s", at.Sub(start), ok)
+	}
+
+	// all in one Advance, each at its own deadline
+	for i, d := range deadlines {
+		timers[i].Reset(d)
+	}
+	now := clk.Now()
+	clk.Advance(time.Hour)
+	for i, timer := range timers {
+		if at, ok := fired(timer.C()); !ok || !at.Equal(now.Add(deadlines[i])) {
+			t.Errorf("timer %d fired at %v (%v), want %v",
+				i, at.Sub(now), ok, deadlines[i])
+		}
+	}
+	if clk.Waiters() != 0 {
+		t.Errorf("%d waiters left after every timer fired", clk.Waiters())
+	}
+	if !clk.Now().Equal(now.Add(time.Hour)) {
+		t.Errorf("clock at %v after Advance, want an hour later", clk.Now().Sub(now))
+	}
+}
+
+func TestFakeStopAndReset(t *testing.T) {
+	clk := NewFake(start)
+	stopped := clk.NewTimer(time.Second)
+	moved := clk.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop of a waiting timer returned false")
+	}
+	if !moved.Reset(3 * time.Second) {
+		t.Error("Reset of a waiting timer returned false")
+	}
+
+	clk.Advance(2 * time.Second)
+	if _, ok := fired(stopped.C()); ok {
+		t.Error("stopped timer fired")
+	}
+	if _, ok := fired(moved.C()); ok {
+		t.Error("reset timer fired at its old deadline")
+	}
+	clk.Advance(time.Second)
+	if _, ok := fired(moved.C()); !ok {
+		t.Error("reset timer didn't fire at its new deadline")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	clk := NewFake(start)
+	ticker := clk.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// the ticks after the first are dropped, it's not received
+	clk.Advance(3500 * time.Millisecond)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(start.Add(time.Second)) {
+		t.Errorf("first tick at %v (%v), want 1s", at.Sub(start), ok)
+	}
+	if _, ok := fired(ticker.C()); ok {
+		t.Error("more than one tick waiting")
+	}
+	clk.Advance(500 * time.Millisecond)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(start.Add(4*time.Second)) {
+		t.Errorf("tick at %v (%v), want 4s", at.Sub(start), ok)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"../../network/conn"
+	"../../watchdog"
+)
+
+const (
+	// How long to wait for the elevator to exit after SIGTERM before it's
+	// killed. The elevator stops at the next floor before exiting, which can
+	// take a few seconds.
+	killGrace time.Duration = 12 * time.Second
+	// How often to check if the heartbeat has timed out.
+	checkInterval time.Duration = 100 * time.Millisecond
+	// How long to wait after a failed heartbeat read. The wait doubles on
+	// every failure in a row, up to readBackoffMax.
+	readBackoffMin time.Duration = 10 * time.Millisecond
+	readBackoffMax time.Duration = 1 * time.Second
+)
+
+// config is the supervisor settings, see parseFlags.
+type config struct {
+	port          int
+	message       string
+	args          []string
+	timeout       time.Duration
+	startupGrace  time.Duration
+	backoffMin    time.Duration
+	backoffMax    time.Duration
+	backoffReset  time.Duration
+	maxRestarts   int
+	restartWindow time.Duration
+	logDir        string
+	logMaxSize    int64
+	logBackups    int
+}
+
+func parseFlags() config {
+	var c config
+	var execF string
+	var logMaxSizeF int
+	flag.IntVar(&c.port, "port", 57005, "UDP port to receive heartbeats on")
+	flag.StringVar(&c.message, "message", "28-IAmAlive",
+		"Heartbeat message sent by the elevator, followed by ':' and its PID")
+	flag.StringVar(&execF, "exec", "", "Command that starts the elevator")
+	flag.DurationVar(&c.timeout, "timeout", 2*time.Second,
+		"Restart the elevator if no heartbeat is received for this long")
+	flag.DurationVar(&c.startupGrace, "startup-grace", 5*time.Second,
+		"How long the elevator has to send its first heartbeat")
+	flag.DurationVar(&c.backoffMin, "backoff-min", 500*time.Millisecond,
+		"Delay before the first restart")
+	flag.DurationVar(&c.backoffMax, "backoff-max", 30*time.Second,
+		"Max delay between restarts, the delay doubles on every restart")
+	flag.DurationVar(&c.backoffReset, "backoff-reset", time.Minute,
+		"Reset the delay if the elevator ran this long before it died")
+	flag.IntVar(&c.maxRestarts, "max-restarts", 10,
+		"Give up if the elevator is restarted this many times within -restart-window")
+	flag.DurationVar(&c.restartWindow, "restart-window", 5*time.Minute,
+		"Window for -max-restarts")
+	flag.StringVar(&c.logDir, "logdir", "logs", "Directory for the elevator output")
+	flag.IntVar(&logMaxSizeF, "log-max-size", 10*1024*1024,
+		"Rotate the elevator output when it reaches this many bytes")
+	flag.IntVar(&c.logBackups, "log-backups", 5, "How many rotated output files to keep")
+	flag.Parse()
+
+	c.args = strings.Fields(execF)
+	c.logMaxSize = int64(logMaxSizeF)
+	return c
+}
+
+// withFromFile returns args with --fromfile added if it's not there.
+func withFromFile(args []string) []string {
+	for _, a := range args[1:] {
+		if a == "--fromfile" || a == "-fromfile" {
+			return args
+		}
+	}
+	res := append([]string{}, args...)
+	return append(res, "--fromfile")
+}
+
+// heartbeat returns how the heartbeat message of the elevator with pid ends.
+// The elevator broadcasts "message:pid" like any other string on the network,
+// which is the type name followed by the message as JSON, see bcast.
+func heartbeat(message string, pid int) string {
+	data, _ := json.Marshal(fmt.Sprintf("%s:%d", message, pid))
+	return "string" + string(data)
+}
+
+// receiveHeartbeats sends every received message on beats. Failed reads are
+// retried with a growing wait, so an error that doesn't go away doesn't keep
+// the supervisor busy; the elevator is then restarted for missing heartbeats
+// as usual.
+func receiveHeartbeats(port int, beats chan<- string) error {
+	c, err := conn.DialBroadcastUDP(port)
+	if err != nil {
+		return err
+	}
+	go func() {
+		var buf [1024]byte
+		backoff := readBackoffMin
+		for {
+			n, _, err := c.ReadFrom(buf[:])
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("Reading heartbeat failed: %v. Retrying in %s.\n", err, backoff)
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > readBackoffMax {
+					backoff = readBackoffMax
+				}
+				continue
+			}
+			backoff = readBackoffMin
+			beats <- string(buf[:n])
+		}
+	}()
+	return nil
+}
+
+// outcome is what to do after the elevator has exited.
+type outcome int
+
+const (
+	restart outcome = iota
+	// the elevator stopped on request, or the supervisor received a signal
+	exit
+	// the elevator can't be started with the given arguments
+	giveUp
+)
+
+// run starts the elevator and supervises it until it exits or stops sending
+// heartbeats, in which case it's killed. Returns how long it ran and what to
+// do next, which depends on the exit code if the elevator exited by itself,
+// see the watchdog exit codes.
+func run(c config, args []string, out io.Writer, beats <-chan string,
+	sigs <-chan os.Signal) (time.Duration, outcome) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// the elevator gets its own process group, so that Ctrl-C in the terminal
+	// only reaches the supervisor. Otherwise the elevator would get SIGINT and
+	// then the SIGTERM from stop, and take the second signal as a request to
+	// stop immediately, between floors.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		log.Printf("Could not start elevator: %v\n", err)
+		return 0, restart
+	}
+	pid := cmd.Process.Pid
+	log.Printf("Started elevator with PID %d: %s\n", pid, strings.Join(args, " "))
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	expected := heartbeat(c.message, pid)
+	lastBeat := time.Time{}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			log.Printf("Elevator exited: %v\n", exitDescription(err))
+			switch cmd.ProcessState.ExitCode() {
+			case watchdog.ExitStopped:
+				log.Println("Elevator was stopped on request. Not restarting it.")
+				return time.Since(start), exit
+			case watchdog.ExitUsage:
+				return time.Since(start), giveUp
+			}
+			return time.Since(start), restart
+
+		case msg := <-beats:
+			// the whole message must match, or PID 12 would also be fed by
+			// PID 123
+			if strings.HasSuffix(msg, expected) {
+				lastBeat = time.Now()
+			}
+
+		case <-ticker.C:
+			var missing bool
+			if lastBeat.IsZero() {
+				missing = time.Since(start) > c.startupGrace
+			} else {
+				missing = time.Since(lastBeat) > c.timeout
+			}
+			if missing {
+				log.Printf("No heartbeat from PID %d. Killing it.\n", pid)
+				stop(cmd, exited)
+				return time.Since(start), restart
+			}
+
+		case sig := <-sigs:
+			log.Printf("Received signal: %s. Stopping elevator...\n", sig.String())
+			stop(cmd, exited)
+			return time.Since(start), exit
+		}
+	}
+}
+
+// stop asks the elevator to exit with SIGTERM, and kills it if it hasn't
+// exited within killGrace.
+func stop(cmd *exec.Cmd, exited <-chan error) {
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		log.Printf("Elevator exited: %v\n", exitDescription(err))
+	case <-time.After(killGrace):
+		log.Println("Elevator didn't exit in time. Sending SIGKILL.")
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+func exitDescription(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
+	c := parseFlags()
+	if len(c.args) == 0 {
+		fmt.Fprintln(os.Stderr, "Missing -exec. Usage:")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if err := os.MkdirAll(c.logDir, 0755); err != nil {
+		log.Fatalf("Could not create log directory: %v\n", err)
+	}
+	logName := filepath.Join(c.logDir, fmt.Sprintf("heis%d.log", c.port))
+	out, err := openRotatingFile(logName, c.logMaxSize, c.logBackups)
+	if err != nil {
+		log.Fatalf("Could not open log file: %v\n", err)
+	}
+	defer out.Close()
+	log.Printf("Elevator output is written to %s\n", logName)
+
+	beats := make(chan string, 16)
+	if err := receiveHeartbeats(c.port, beats); err != nil {
+		log.Fatalf("Could not listen for heartbeats on port %d: %v\n", c.port, err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	args := c.args
+	backoff := c.backoffMin
+	var restarts []time.Time
+	for {
+		ran, next := run(c, args, out, beats, sigs)
+		switch next {
+		case exit:
+			return
+		case giveUp:
+			log.Fatalf("Elevator was started with invalid arguments. Giving up.\n")
+		}
+
+		// the elevator must pick up where it left off from now on
+		args = withFromFile(c.args)
+
+		now := time.Now()
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > c.restartWindow {
+			restarts = restarts[1:]
+		}
+		if len(restarts) > c.maxRestarts {
+			log.Fatalf("Elevator died %d times within %s. Giving up.\n",
+				len(restarts), c.restartWindow)
+		}
+
+		if ran > c.backoffReset {
+			backoff = c.backoffMin
+		}
+		log.Printf("Restarting elevator in %s\n", backoff)
+		select {
+		case <-time.After(backoff):
+		case sig := <-sigs:
+			log.Printf("Received signal: %s. Exiting...\n", sig.String())
+			return
+		}
+		backoff *= 2
+		if backoff > c.backoffMax {
+			backoff = c.backoffMax
+		}
+	}
+}
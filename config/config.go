@@ -0,0 +1,357 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"../control"
+	"../driver"
+	"../logging"
+	"../store"
+	"../watchdog"
+)
+
+// DefaultNetworkPort is the UDP port the elevators talk to each other on.
+const DefaultNetworkPort int = 20028
+
+// Duration is a time.Duration written as a string like "3s" or "250ms" in
+// the config file.
+type Duration time.Duration
+
+// MarshalJSON writes d as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a string like "3s" into d.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"3s\" or \"250ms\", got %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration \"%s\", must be like \"3s\" or \"250ms\"", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// String returns the duration like time.Duration does.
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses s, so a Duration can be used with flag.Var.
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Elevator is the settings of the local elevator.
+type Elevator struct {
+	// Port is the port of the elevator server.
+	Port   int `json:"port"`
+	Floors int `json:"floors"`
+	// Store is the backend for persisting the elevator state, see store.Open.
+	Store string `json:"store"`
+	// FromFile restores the elevator from the store at startup.
+	FromFile bool `json:"fromfile"`
+}
+
+// Watchdog is the settings for talking to the watchdog program.
+type Watchdog struct {
+	Port    int    `json:"port"`
+	Message string `json:"message"`
+	// Mode is one of watchdog.Modes.
+	Mode string `json:"mode"`
+}
+
+// Network is the settings for talking to the other elevators.
+type Network struct {
+	Port int `json:"port"`
+	// OrderCopies is how many copies of each order message to send.
+	OrderCopies int `json:"order_copies"`
+}
+
+// Driver is the timeouts of the driver, see driver.Timing.
+type Driver struct {
+	DoorTime           Duration `json:"door_time"`
+	FloorChangeTimeout Duration `json:"floor_change_timeout"`
+	FindFloorTimeout   Duration `json:"find_floor_timeout"`
+}
+
+// Orders is the settings for distributing orders.
+type Orders struct {
+	// Timeout is how long an order can be taken before it must be finished.
+	Timeout Duration `json:"timeout"`
+	// DistancePenalty and Backoff decide how long to wait before claiming an
+	// order, see control.Config.
+	DistancePenalty Duration `json:"distance_penalty"`
+	Backoff         Duration `json:"backoff"`
+}
+
+// Config is all settings of the program. It's read from a JSON file, where
+// missing fields keep their default values.
+type Config struct {
+	Elevator Elevator `json:"elevator"`
+	Watchdog Watchdog `json:"watchdog"`
+	Network  Network  `json:"network"`
+	Driver   Driver   `json:"driver"`
+	Orders   Orders   `json:"orders"`
+	// EventLog writes every elevator event to the log.
+	EventLog bool `json:"event_log"`
+	// LogLevel is one of logging.Levels.
+	LogLevel string `json:"log_level"`
+}
+
+// Default returns the configuration used when nothing else is given.
+func Default() Config {
+	return Config{
+		Elevator: Elevator{Port: 15657, Floors: 4, Store: "file"},
+		Watchdog: Watchdog{Port: 57005, Message: "28-IAmAlive", Mode: "udp"},
+		Network:  Network{Port: DefaultNetworkPort, OrderCopies: control.DefaultOrderCopies},
+		Driver: Driver{
+			DoorTime:           Duration(driver.DefaultTiming.Door),
+			FloorChangeTimeout: Duration(driver.DefaultTiming.FloorChange),
+			FindFloorTimeout:   Duration(driver.DefaultTiming.FindFloor),
+		},
+		Orders: Orders{
+			Timeout:         Duration(driver.DefaultTiming.Order),
+			DistancePenalty: Duration(control.DefaultDistancePenalty),
+			Backoff:         Duration(control.DefaultBackoff),
+		},
+		LogLevel: logging.Debug.String(),
+	}
+}
+
+// Load reads the file at path on top of the defaults. Unknown fields are
+// errors, so misspelled settings aren't silently ignored. The result isn't
+// validated.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return cfg, fmt.Errorf("%s:%d: %v", path, line(data, syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return cfg, fmt.Errorf("%s:%d: %s must be %s, got %s", path,
+				line(data, typeErr.Offset), typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return cfg, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// line returns the line number of offset in data.
+func line(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// ValidationError is all problems found in a configuration.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks every setting and returns a ValidationError listing all
+// problems, or nil.
+func (cfg Config) Validate() error {
+	var errs ValidationError
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	ports := map[string]int{
+		"elevator.port": cfg.Elevator.Port,
+		"watchdog.port": cfg.Watchdog.Port,
+		"network.port":  cfg.Network.Port,
+	}
+	for _, name := range []string{"elevator.port", "watchdog.port", "network.port"} {
+		check(ports[name] > 0 && ports[name] < 65536,
+			"%s is %d, must be between 1 and 65535", name, ports[name])
+	}
+	check(cfg.Elevator.Port != cfg.Watchdog.Port,
+		"elevator.port and watchdog.port are both %d", cfg.Elevator.Port)
+	check(cfg.Network.Port != cfg.Watchdog.Port,
+		"network.port and watchdog.port are both %d", cfg.Network.Port)
+
+	check(cfg.Elevator.Floors >= 2, "elevator.floors is %d, must be at least 2",
+		cfg.Elevator.Floors)
+	check(contains(store.Backends, cfg.Elevator.Store),
+		"elevator.store is '%s', must be one of %v", cfg.Elevator.Store, store.Backends)
+	check(contains(watchdog.Modes, cfg.Watchdog.Mode),
+		"watchdog.mode is '%s', must be one of %v", cfg.Watchdog.Mode, watchdog.Modes)
+	check(cfg.Watchdog.Message != "", "watchdog.message must not be empty")
+	check(contains(logging.Levels, cfg.LogLevel),
+		"log_level is '%s', must be one of %v", cfg.LogLevel, logging.Levels)
+	check(cfg.Network.OrderCopies >= 1, "network.order_copies is %d, must be at least 1",
+		cfg.Network.OrderCopies)
+
+	positive := []struct {
+		name string
+		d    Duration
+	}{
+		{"driver.door_time", cfg.Driver.DoorTime},
+		{"driver.floor_change_timeout", cfg.Driver.FloorChangeTimeout},
+		{"driver.find_floor_timeout", cfg.Driver.FindFloorTimeout},
+		{"orders.distance_penalty", cfg.Orders.DistancePenalty},
+		{"orders.backoff", cfg.Orders.Backoff},
+	}
+	for _, p := range positive {
+		check(p.d > 0, "%s is %s, must be positive", p.name, p.d)
+	}
+	// the order timeout is counted in whole seconds, and an order must be
+	// able to finish with the door open for the full door time
+	check(cfg.Orders.Timeout >= Duration(time.Second),
+		"orders.timeout is %s, must be at least 1s", cfg.Orders.Timeout)
+	check(cfg.Orders.Timeout > cfg.Driver.DoorTime,
+		"orders.timeout (%s) must be longer than driver.door_time (%s)",
+		cfg.Orders.Timeout, cfg.Driver.DoorTime)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Settings returns the settings of the controller that can be changed while
+// it runs, see control.Controller.Reload.
+func (cfg Config) Settings() control.Settings {
+	return control.Settings{
+		Timing: driver.Timing{
+			Door:        time.Duration(cfg.Driver.DoorTime),
+			FloorChange: time.Duration(cfg.Driver.FloorChangeTimeout),
+			FindFloor:   time.Duration(cfg.Driver.FindFloorTimeout),
+			Order:       time.Duration(cfg.Orders.Timeout),
+		},
+		DistancePenalty: time.Duration(cfg.Orders.DistancePenalty),
+		Backoff:         time.Duration(cfg.Orders.Backoff),
+	}
+}
+
+// Level returns the log level of cfg, which must be valid.
+func (cfg Config) Level() logging.Level {
+	l, _ := logging.Parse(cfg.LogLevel)
+	return l
+}
+
+// Difference is a setting that has different values in two configurations,
+// written as in the file.
+type Difference struct {
+	Name string
+	From string
+	To   string
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: %s -> %s", d.Name, d.From, d.To)
+}
+
+// Reloadable reports whether the setting can be changed while the program
+// runs. These are the settings in control.Settings and the log level.
+func (d Difference) Reloadable() bool {
+	return strings.HasPrefix(d.Name, "driver.") || strings.HasPrefix(d.Name, "orders.") ||
+		d.Name == "log_level"
+}
+
+// Diff returns every setting that's different in other, sorted by name, like
+// "driver.door_time".
+func (cfg Config) Diff(other Config) []Difference {
+	before, after := cfg.flatten(), other.flatten()
+	names := make([]string, 0, len(before))
+	for name := range before {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var diffs []Difference
+	for _, name := range names {
+		if before[name] != after[name] {
+			diffs = append(diffs, Difference{name, before[name], after[name]})
+		}
+	}
+	return diffs
+}
+
+// Reload returns cfg with the settings that can be changed while the program
+// runs taken from next. changed describes each of them that's different, and
+// ignored each other setting that's different in next, which needs a restart
+// to take effect.
+func (cfg Config) Reload(next Config) (reloaded Config, changed, ignored []string) {
+	for _, d := range cfg.Diff(next) {
+		if d.Reloadable() {
+			changed = append(changed, d.String())
+		} else {
+			ignored = append(ignored, d.String())
+		}
+	}
+
+	reloaded = cfg
+	reloaded.Driver = next.Driver
+	reloaded.Orders = next.Orders
+	reloaded.LogLevel = next.LogLevel
+	return reloaded, changed, ignored
+}
+
+// flatten returns every setting of cfg by its name in the file, like
+// "driver.door_time", written as in the file.
+func (cfg Config) flatten() map[string]string {
+	var tree map[string]interface{}
+	data, _ := json.Marshal(cfg)
+	json.Unmarshal(data, &tree)
+
+	settings := make(map[string]string)
+	for name, v := range tree {
+		section, ok := v.(map[string]interface{})
+		if !ok {
+			settings[name] = fmt.Sprint(v)
+			continue
+		}
+		for key, v := range section {
+			settings[name+"."+key] = fmt.Sprint(v)
+		}
+	}
+	return settings
+}
+
+// String returns cfg as indented JSON, in the format read by Load.
+func (cfg Config) String() string {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		// want is part of the only problem reported
+		want string
+	}{
+		{"port zero", func(cfg *Config) { cfg.Elevator.Port = 0 }, "elevator.port is 0"},
+		{"port too high", func(cfg *Config) { cfg.Network.Port = 65536 }, "network.port is 65536"},
+		{"same port as watchdog", func(cfg *Config) { cfg.Elevator.Port = cfg.Watchdog.Port },
+			"elevator.port and watchdog.port"},
+		{"network on watchdog port", func(cfg *Config) { cfg.Network.Port = cfg.Watchdog.Port },
+			"network.port and watchdog.port"},
+		{"one floor", func(cfg *Config) { cfg.Elevator.Floors = 1 }, "elevator.floors is 1"},
+		{"unknown store", func(cfg *Config) { cfg.Elevator.Store = "tape" }, "elevator.store"},
+		{"unknown watchdog mode", func(cfg *Config) { cfg.Watchdog.Mode = "tcp" }, "watchdog.mode"},
+		{"empty watchdog message", func(cfg *Config) { cfg.Watchdog.Message = "" },
+			"watchdog.message"},
+		{"unknown log level", func(cfg *Config) { cfg.LogLevel = "loud" }, "log_level"},
+		{"no order copies", func(cfg *Config) { cfg.Network.OrderCopies = 0 },
+			"network.order_copies"},
+		{"no door time", func(cfg *Config) { cfg.Driver.DoorTime = 0 }, "driver.door_time is 0s"},
+		{"negative backoff", func(cfg *Config) { cfg.Orders.Backoff = Duration(-time.Second) },
+			"orders.backoff"},
+		{"order timeout below a second", func(cfg *Config) {
+			cfg.Driver.DoorTime = Duration(100 * time.Millisecond)
+			cfg.Orders.Timeout = Duration(500 * time.Millisecond)
+		}, "orders.timeout is 500ms"},
+		{"order timeout within door time", func(cfg *Config) {
+			cfg.Orders.Timeout = cfg.Driver.DoorTime
+		}, "must be longer than driver.door_time"},
+	}
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("default configuration rejected: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			errs, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("Validate returned %v, want a ValidationError", err)
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0], tt.want) {
+				t.Errorf("Validate reported %q, want one problem with %q", []string(errs), tt.want)
+			}
+		})
+	}
+}
@@ -1,20 +1,28 @@
 package control
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math"
 	"math/rand"
 	"os"
-	"strconv"
 	"time"
 
+	"../clock"
 	"../driver"
 	"../elevTypes/elevator"
 	"../elevTypes/order"
-	"../filebackup"
-	"../network"
-	"../request"
+	"../events"
+	"../group"
+	"../health"
+	"../journal"
+	"../logging"
+	"../network/bcast"
+	"../network/peers"
+	"../network/txqueue"
+	"../store"
 	"../watchdog"
 )
 
@@ -23,58 +31,247 @@ import (
 const (
 	// How often to check if an order has timed out.
 	checkTimestampInterval time.Duration = 100 * time.Millisecond
-	// How ofter to write the current state to a backup file.
-	writeToFileInterval time.Duration = 90 * time.Millisecond
+	// How often to compact the journal into a backup snapshot.
+	compactionInterval time.Duration = 10 * time.Second
+	// How often to log the transmit queue metrics.
+	txQueueMetricsInterval time.Duration = 10 * time.Second
 )
 
-var (
-	// orderTimer is used to wait before an order is accepted.
-	orderTimer *time.Timer
-	// will be formatted in main
-	backupFileName string = "logs/elevBackupFile_%d.log"
+const (
+	// How many messages can wait to be transmitted.
+	txQueueCapacity int = 64
+	// How many journal entries before the journal is compacted regardless of
+	// compactionInterval.
+	compactAfterEntries int = 200
+	// How many events can wait for the event log before new ones are
+	// dropped.
+	eventLogBuffer int = 64
+)
 
-	Nfloors  int
-	Nbuttons int = 3
+const (
+	// healthName is the name the control loop reports progress under, see
+	// the health package.
+	healthName string = "control"
+	// The loop wakes up every checkTimestampInterval, so it's stuck
+	// if it hasn't made progress for this long.
+	healthTimeout time.Duration = 1 * time.Second
 )
 
-var (
+// Defaults for the zero values in Config.
+const (
+	// DefaultDistancePenalty is how much longer to wait before claiming an
+	// order for each floor away it is.
+	DefaultDistancePenalty time.Duration = 250 * time.Millisecond
+	// DefaultBackoff is the largest random time added to or subtracted from
+	// the wait before claiming an order.
+	DefaultBackoff time.Duration = 100 * time.Millisecond
+	// DefaultOrderCopies is how many copies of each order message to send.
+	DefaultOrderCopies int = 10
+)
+
+// txPolicies says how many copies of each message type to send. Heartbeats
+// are sent periodically anyway, while a lost order message is only recovered
+// by the order timeout.
+func txPolicies(orderCopies int) bcast.Policies {
+	return bcast.Policies{
+		bcast.PolicyKey(peers.Heartbeat{}): {Copies: 1},
+		bcast.PolicyKey(order.Order{}): {Copies: orderCopies,
+			Spacing: 10 * time.Millisecond, Jitter: 4 * time.Millisecond},
+		bcast.PolicyKey(StateSync{}): {
+			Copies: 5, Spacing: 20 * time.Millisecond, Jitter: 8 * time.Millisecond},
+		bcast.PolicyKey(StateRequest{}): {
+			Copies: 5, Spacing: 20 * time.Millisecond, Jitter: 8 * time.Millisecond},
+	}
+}
+
+// txRules says how messages are queued for transmission. Only the latest
+// heartbeat, state sync and state request is of interest, and for orders only the latest
+// status of each floor and type, so these are coalesced.
+var txRules = txqueue.Rules{
+	bcast.PolicyKey(peers.Heartbeat{}): {Policy: txqueue.Coalesce},
+	bcast.PolicyKey(StateSync{}):       {Policy: txqueue.Coalesce},
+	bcast.PolicyKey(StateRequest{}):    {Policy: txqueue.Coalesce},
+	bcast.PolicyKey(order.Order{}): {
+		Policy: txqueue.Coalesce,
+		Key: func(msg interface{}) string {
+			o := msg.(order.Order)
+			return fmt.Sprintf("%d:%d", o.Floor, o.Type)
+		},
+	},
+}
+
+// Config is the settings of one elevator.
+type Config struct {
+	// ID identifies the elevator on the network. Lower IDs win duplicate
+	// claims during reconciliation.
+	ID       string
+	Nfloors  int
+	Nbuttons int
+	// Restore makes the elevator continue from the state in the store and
+	// its journal, see store.Store.
+	Restore bool
+	// OrderCopies is how many copies of each order message to send. Zero
+	// means DefaultOrderCopies.
+	OrderCopies int
+	// EventLog writes every event on the bus to the log, see events.Log.
+	EventLog bool
+
+	Settings
+}
+
+// Settings is the part of Config that can be changed while the controller
+// runs, see Reload.
+type Settings struct {
+	// Timing is the timeouts of the driver. Zero fields are taken from
+	// driver.DefaultTiming.
+	Timing driver.Timing
+	// DistancePenalty and Backoff decide how long to wait before claiming an
+	// order, see startOrderTimer. Zero means DefaultDistancePenalty and
+	// DefaultBackoff.
+	DistancePenalty time.Duration
+	Backoff         time.Duration
+}
+
+// withDefaults returns cfg with the zero values replaced by defaults.
+func (cfg Config) withDefaults() Config {
+	cfg.Settings = cfg.Settings.withDefaults()
+	if cfg.OrderCopies == 0 {
+		cfg.OrderCopies = DefaultOrderCopies
+	}
+	return cfg
+}
+
+// withDefaults returns s with the zero values replaced by defaults.
+func (s Settings) withDefaults() Settings {
+	t := &s.Timing
+	if t.Door == 0 {
+		t.Door = driver.DefaultTiming.Door
+	}
+	if t.FloorChange == 0 {
+		t.FloorChange = driver.DefaultTiming.FloorChange
+	}
+	if t.FindFloor == 0 {
+		t.FindFloor = driver.DefaultTiming.FindFloor
+	}
+	if t.Order == 0 {
+		t.Order = driver.DefaultTiming.Order
+	}
+	if s.DistancePenalty == 0 {
+		s.DistancePenalty = DefaultDistancePenalty
+	}
+	if s.Backoff == 0 {
+		s.Backoff = DefaultBackoff
+	}
+	return s
+}
+
+// Network runs the transmitter and receiver of a controller until ctx is
+// cancelled, implemented by network.UDP and loopback.Node. Messages on txChan
+// are sent according to policies, and received messages are output on the
+// rxChans with the matching element type.
+type Network interface {
+	Run(ctx context.Context, policies bcast.Policies, txChan chan interface{},
+		rxChans ...interface{}) error
+}
+
+// Scheduler selects the next order to execute, implemented by
+// request.Scheduler.
+type Scheduler interface {
+	FindNextOrder(elev elevator.Elevator) order.Order
+}
+
+// Dependencies is what a controller uses to talk to the world. Each
+// controller needs its own.
+type Dependencies struct {
+	IO        driver.IO
+	Network   Network
+	Store     store.Store
+	Scheduler Scheduler
+	// Clock is used for all timing in the controller and its driver. The
+	// system clock is used if it's nil.
+	Clock clock.Clock
+	// Rand is used for the backoff before claiming an order. A randomly
+	// seeded source is used if it's nil.
+	Rand *rand.Rand
+	// Bus is where the driver and control publish what happens to the
+	// elevator. It must not be shared with another elevator. A new bus is
+	// used if it's nil.
+	Bus *events.Bus
+}
+
+// Controller runs the control logic for one elevator. Several controllers can
+// run in the same process.
+type Controller struct {
+	cfg       Config
+	io        driver.IO
+	network   Network
+	store     store.Store
+	scheduler Scheduler
+	clock     clock.Clock
+	rng       *rand.Rand
+	bus       *events.Bus
+
+	// orderTimer is used to wait before an order is accepted.
+	orderTimer clock.Timer
+	// journal records state changes between backup snapshots.
+	journal *journal.Journal
+
+	// tracker keeps track of reachable peers.
+	tracker *peers.Tracker
+	// lostPeers is the peers that have been lost and not seen again since.
+	// While non-empty the network is assumed to be partitioned.
+	lostPeers map[string]bool
+
+	restoring restoreState
+	stopping  shutdownState
+
+	// initElev is the state the driver starts in.
+	initElev elevator.Elevator
+
+	// settingsChan receives new settings from Reload, and timingChan passes
+	// the new timing on to the driver.
+	settingsChan chan Settings
+	timingChan   chan driver.Timing
+
 	mainElevatorChan chan elevator.Elevator
 	orderChan        chan order.Order
 	buttonPressChan  chan order.Order
+	stopChan         chan bool
+	stoppedChan      chan elevator.Elevator
 
 	txChan           chan interface{}
+	txQueue          *txqueue.Queue
 	networkOrderChan chan order.Order
-)
+	heartbeatChan    chan peers.Heartbeat
+	syncChan         chan StateSync
+	requestChan      chan StateRequest
+}
 
 // startOrderTimer selects delay based on distance to order and a random backoff
 // interval. Similar to 802.11 protocol.
-func startOrderTimer(newElev elevator.Elevator, nextOrder order.Order) {
+func (c *Controller) startOrderTimer(newElev elevator.Elevator, nextOrder order.Order) {
 	// find wait duration based on distance
-	distPenalty := 250.0 // how much to space distance in time
 	dist := math.Abs(float64(nextOrder.Floor) - float64(newElev.Floor))
-	orderWaitInterval := time.Duration(distPenalty*dist) * time.Millisecond
+	orderWaitInterval := time.Duration(float64(c.cfg.DistancePenalty) * dist)
 
 	// add random number to avoid time collisions
-	backoffInterval := 100000
+	backoffInterval := int(c.cfg.Backoff / time.Microsecond)
 	lower := -backoffInterval
 	upper := backoffInterval
-	duration := lower + rand.Intn(upper-lower)
+	duration := lower + c.rng.Intn(upper-lower)
 	orderWaitInterval += (time.Duration(duration) * time.Microsecond)
 
-	orderTimer.Reset(orderWaitInterval) // resets starts the timer again
+	c.orderTimer.Reset(orderWaitInterval) // resets starts the timer again
 }
 
 // startNextOrder checks if nextOrder is still not taken and executes it. This
 // function is run when orderTimer times out.
-func startNextOrder(
-	elev elevator.Elevator,
-	nextOrder order.Order,
-	orderChan chan<- order.Order,
-	txChan chan<- interface{}) {
+func (c *Controller) startNextOrder(elev elevator.Elevator, nextOrder order.Order) {
 	// Check if next order to execute is already taken
 	if nextOrder.Status != order.Invalid &&
 		elev.Orders[nextOrder.Floor][nextOrder.Type].Status == order.NotTaken {
-		orderChan <- nextOrder
+		c.publish(events.Event{Kind: events.OrderClaimed, Order: nextOrder})
+		c.orderChan <- nextOrder
 
 		// tell the other elevators that the last active order
 		// is no longer active and someone else can take it
@@ -85,24 +282,23 @@ func startNextOrder(
 				"Sending NotTaken.")
 			o := elev.ActiveOrder
 			o.Status = order.NotTaken
-			txChan <- o
+			c.txQueue.Push(o)
 		}
 	}
 }
 
 // updatedElevatorState handles when a new Elevator object is received from the
 // driver.
-func updatedElevatorState(
+func (c *Controller) updatedElevatorState(
 	newElev elevator.Elevator,
-	elev elevator.Elevator,
-	txChan chan<- interface{}) (elevator.Elevator, order.Order) {
+	elev elevator.Elevator) (elevator.Elevator, order.Order) {
 
-	log.Println(newElev.ToString())
-	log.Println(newElev.OrderMatrixToString())
+	logging.Debugf("%s\n", newElev.ToString())
+	logging.Debugf("%s\n", newElev.OrderMatrixToString())
 
-	nextOrder := request.FindNextOrder(newElev)
+	nextOrder := c.scheduler.FindNextOrder(newElev)
 	if nextOrder.Status != order.Invalid {
-		startOrderTimer(newElev, nextOrder)
+		c.startOrderTimer(newElev, nextOrder)
 	}
 
 	if newElev.ActiveOrder.Status == order.Finished ||
@@ -110,7 +306,7 @@ func updatedElevatorState(
 		// Only transmit if active order changed, and not cab order
 		if !order.CompareEq(elev.ActiveOrder, newElev.ActiveOrder) &&
 			newElev.ActiveOrder.Type != order.Cab {
-			txChan <- newElev.ActiveOrder
+			c.txQueue.Push(newElev.ActiveOrder)
 		}
 	}
 
@@ -119,7 +315,7 @@ func updatedElevatorState(
 		o := newElev.ActiveOrder
 		o.Status = order.NotTaken
 		if o.Type != order.Cab {
-			txChan <- o
+			c.txQueue.Push(o)
 			log.Println("Entered error state. Sending active order on network.")
 		}
 	}
@@ -127,82 +323,334 @@ func updatedElevatorState(
 	return newElev, nextOrder
 }
 
-func newButtonPress(ord order.Order, txChan chan interface{}) {
+func (c *Controller) newButtonPress(ord order.Order) {
+	c.publish(events.Event{Kind: events.OrderRequested, Order: ord})
 	if ord.Type != order.Cab {
-		txChan <- ord
+		c.txQueue.Push(ord)
 		log.Printf("Sending order on network: %s\n", ord.ToString())
 	}
 }
 
-func newNetworkMessage(ord order.Order, orderChan chan<- order.Order) {
+func (c *Controller) newNetworkMessage(ord order.Order, elev elevator.Elevator) {
 	log.Printf("Received order from network: %s\n", ord.ToString())
-	orderChan <- ord
+	if ord.Status == order.Taken && ord.Type != order.Cab &&
+		elev.ActiveOrder.Status == order.Taken &&
+		order.CompareFloorAndType(ord, elev.ActiveOrder) {
+		// Two elevators took the same order at once. A Taken order for the
+		// active order makes the driver release it, so keep it here.
+		log.Println("Another elevator took the active order too. Keeping it.")
+		return
+	}
+	c.orderChan <- ord
 }
 
-// Setup initializes the driver and network module as well as sets up other
-// variables for controlling the elevator.
-func Setup(elevIOport, nfloors int, readFile bool) {
-	rand.Seed(time.Now().UnixNano())
-	Nfloors = nfloors
+// publish sends ev on the event bus, stamped with the current time.
+func (c *Controller) publish(ev events.Event) {
+	ev.Time = c.clock.Now()
+	c.bus.Publish(ev)
+}
 
-	var elev elevator.Elevator = elevator.NewElevator(Nfloors, Nbuttons)
-	mainElevatorChan = make(chan elevator.Elevator, 100)
-	orderChan = make(chan order.Order, 100)
-	buttonPressChan = make(chan order.Order)
-	backupFileName = fmt.Sprintf(backupFileName, elevIOport)
-	if readFile {
-		elev = filebackup.Read(backupFileName, Nfloors, Nbuttons)
-		o := elev.ActiveOrder
-		o.Status = order.Execute
-		orderChan <- o
+// record writes ev to the journal. It observes the bus, and the events the
+// journal records are only published by the control loop.
+func (c *Controller) record(ev events.Event) {
+	if err := c.journal.Record(ev); err != nil {
+		log.Printf("Error writing to journal: %v\n", err)
 	}
-	go driver.Driver(elevIOport, Nfloors, Nbuttons, mainElevatorChan,
-		orderChan, buttonPressChan, elev)
+}
 
-	txChan = make(chan interface{})
-	networkOrderChan = make(chan order.Order)
-	logID := "port" + strconv.Itoa(elevIOport)
-	go network.Network(20028, logID, txChan, networkOrderChan)
+// changeElevator publishes that control takes newElev into use instead of
+// elev, which also journals the change.
+func (c *Controller) changeElevator(elev, newElev elevator.Elevator) {
+	c.publish(events.Event{Kind: events.ElevatorChanged, Previous: elev, Elevator: newElev})
+}
 
-	orderTimer = time.NewTimer(time.Second) // this init time doesn't matter
-	orderTimer.Stop()
+// compact writes elev as a snapshot to the store and empties the journal. The
+// journal is kept if the snapshot can't be written.
+func (c *Controller) compact(elev elevator.Elevator) error {
+	if err := c.store.Save(elev); err != nil {
+		return fmt.Errorf("writing backup, keeping journal: %w", err)
+	}
+	if err := c.journal.Truncate(); err != nil {
+		return fmt.Errorf("truncating journal: %w", err)
+	}
+	return nil
+}
+
+// seed returns a seed for the random backoff which differs between
+// controllers created at the same time.
+func seed(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return time.Now().UnixNano() ^ int64(h.Sum64())
+}
+
+// New creates a controller. If cfg.Restore is set, the elevator continues from
+// the state in the store. An error is returned if the journal can't be opened.
+// Nothing runs before Run is called.
+func New(cfg Config, deps Dependencies) (*Controller, error) {
+	c := &Controller{
+		cfg:       cfg.withDefaults(),
+		io:        deps.IO,
+		network:   deps.Network,
+		store:     deps.Store,
+		scheduler: deps.Scheduler,
+		clock:     deps.Clock,
+		rng:       deps.Rand,
+		bus:       deps.Bus,
+		lostPeers: make(map[string]bool),
+	}
+	if c.clock == nil {
+		c.clock = clock.Real{}
+	}
+	if c.rng == nil {
+		c.rng = rand.New(rand.NewSource(seed(cfg.ID)))
+	}
+	if c.bus == nil {
+		c.bus = events.NewBus()
+	}
+
+	var elev elevator.Elevator = elevator.NewElevator(cfg.Nfloors, cfg.Nbuttons)
+	c.mainElevatorChan = make(chan elevator.Elevator, 100)
+	c.orderChan = make(chan order.Order, 100)
+	c.buttonPressChan = make(chan order.Order)
+	var err error
+	if cfg.Restore {
+		elev, err = c.store.Load()
+		if err != nil {
+			log.Printf("Could not load elevator from store: %v. "+
+				"Starting with a new elevator.\n", err)
+			elev = elevator.NewElevator(cfg.Nfloors, cfg.Nbuttons)
+		}
+		var n int
+		elev, n, err = journal.Replay(c.store.JournalFile(), elev)
+		if err != nil {
+			log.Printf("Error replaying journal: %v\n", err)
+		}
+		log.Printf("Replayed %d journal events\n", n)
+		log.Println(elev.ToString())
+		log.Println(elev.OrderMatrixToString())
+		elev = c.prepareRestore(elev)
+	}
+	if c.journal, err = journal.Open(c.store.JournalFile()); err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	c.bus.Observe(c.record, journal.Kinds...)
+	// start with an empty journal, either because it's replayed above or
+	// because it belongs to an old run
+	if err := c.compact(elev); err != nil {
+		log.Printf("Error compacting journal: %v\n", err)
+	}
+
+	c.initElev = elev
+
+	c.settingsChan = make(chan Settings)
+	c.timingChan = make(chan driver.Timing, 1)
+	c.stopChan = make(chan bool, 2)
+	c.stoppedChan = make(chan elevator.Elevator, 1)
+	c.tracker = peers.NewTracker(cfg.ID, peerTimeout)
+	log.Printf("Node ID: %s\n", cfg.ID)
+
+	c.txChan = make(chan interface{})
+	c.networkOrderChan = make(chan order.Order)
+	c.heartbeatChan = make(chan peers.Heartbeat)
+	c.syncChan = make(chan StateSync)
+	c.requestChan = make(chan StateRequest)
+	c.txQueue = txqueue.New(txQueueCapacity, txRules)
+
+	c.orderTimer = c.clock.NewTimer(time.Second) // this init time doesn't matter
+	c.orderTimer.Stop()
+	return c, nil
+}
+
+// Bus returns the bus where the events of the elevator are published.
+func (c *Controller) Bus() *events.Bus {
+	return c.bus
+}
+
+// Reload makes the controller use s instead of the settings it was created
+// with. It returns when the control loop has received s, or with an error if
+// ctx is cancelled first. See applySettings.
+func (c *Controller) Reload(ctx context.Context, s Settings) error {
+	select {
+	case c.settingsChan <- s:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// applySettings takes s into use. The claim timing is used from the next
+// order timer, and the driver takes the new timing into use at its next state
+// change, so nothing already timed is affected.
+func (c *Controller) applySettings(s Settings) {
+	c.cfg.Settings = s.withDefaults()
+	// the driver only needs the latest timing, replace it if the last one
+	// hasn't been received
+	select {
+	case <-c.timingChan:
+	default:
+	}
+	c.timingChan <- c.cfg.Timing
 }
 
-// Loop starts a for-select loop that runs the control logic for the elevator.
-func Loop(sigs chan os.Signal) {
-	elev := <-mainElevatorChan // halt program until driver is initialized
+// Run runs the driver, the network and the control loop of the elevator. On a
+// signal the elevator is shut down, see beginShutdown, and Run returns the exit
+// code for the watchdog program. If ctx is cancelled, or the network fails,
+// everything is stopped where it is and Run returns ExitRestart and the error
+// of the failing part, if any.
+func (c *Controller) Run(ctx context.Context, sigs <-chan os.Signal) (int, error) {
+	code := watchdog.ExitRestart
+	g, ctx := group.WithContext(ctx)
+	if c.cfg.EventLog {
+		// subscribed before the driver starts, so no event is missed
+		sub := c.bus.Subscribe(eventLogBuffer)
+		g.Go("event log", func(ctx context.Context) error { return events.Log(ctx, sub) })
+	}
+	g.Go("driver", func(ctx context.Context) error {
+		driver.Driver(ctx, c.cfg.ID, c.clock, c.io, c.bus, c.cfg.Timing, c.timingChan,
+			c.cfg.Nfloors, c.cfg.Nbuttons, c.mainElevatorChan, c.orderChan,
+			c.buttonPressChan, c.stopChan, c.stoppedChan, c.initElev)
+		// the driver returns when it has stopped, before the control loop
+		// has finished the shutdown
+		<-ctx.Done()
+		return nil
+	})
+	g.Go("network", func(ctx context.Context) error {
+		return c.network.Run(ctx, txPolicies(c.cfg.OrderCopies), c.txChan,
+			c.networkOrderChan, c.heartbeatChan, c.syncChan, c.requestChan)
+	})
+	g.Go("transmit queue", func(ctx context.Context) error {
+		c.txQueue.Run(ctx, c.txChan)
+		return nil
+	})
+	g.Go("control loop", func(ctx context.Context) error {
+		code = c.loop(ctx, sigs)
+		return nil
+	})
+	err := g.Wait()
+	return code, err
+}
+
+// loop is a for-select loop that runs the control logic for the elevator until
+// the elevator is shut down or ctx is cancelled, and returns the exit code.
+func (c *Controller) loop(ctx context.Context, sigs <-chan os.Signal) int {
+	var elev elevator.Elevator
+	// halt until driver has found a floor. A signal stops the car where it
+	// is, see stopBeforeReady
+	for ready := false; !ready; {
+		select {
+		case elev = <-c.mainElevatorChan:
+			ready = true
+		case sig := <-sigs:
+			c.stopBeforeReady(sig)
+		case <-c.shutdownTimer():
+			return c.finishShutdown(c.initElev, c.initElev, false)
+		case final := <-c.stoppedChan:
+			// stopped before finding a floor
+			return c.finishShutdown(c.initElev, final, true)
+		case <-ctx.Done():
+			return c.abort(c.initElev)
+		}
+	}
+	if !c.stopping.active {
+		watchdog.Ready()
+		c.requestState()
+	}
 	var nextOrder order.Order
+	heartbeatTicker := c.clock.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+	metricsTicker := c.clock.NewTicker(txQueueMetricsInterval)
+	defer metricsTicker.Stop()
+	compactTicker := c.clock.NewTicker(compactionInterval)
+	defer compactTicker.Stop()
+	timestampTicker := c.clock.NewTicker(checkTimestampInterval)
+	defer timestampTicker.Stop()
+	healthName := health.Name(c.cfg.ID, healthName)
+	health.Register(healthName, healthTimeout)
+	defer health.Unregister(healthName)
 	for {
+		health.Beat(healthName)
 		select {
-		case newElev := <-mainElevatorChan:
-			elev, nextOrder = updatedElevatorState(newElev, elev, txChan)
+		case newElev := <-c.mainElevatorChan:
+			if c.stopping.active {
+				c.releaseHeld(elev, newElev)
+			}
+			c.changeElevator(elev, newElev)
+			elev, nextOrder = c.updatedElevatorState(newElev, elev)
+			if c.journal.Entries() >= compactAfterEntries {
+				if err := c.compact(elev); err != nil {
+					log.Printf("Error compacting journal: %v\n", err)
+				}
+			}
+
+		case <-compactTicker.C():
+			if c.journal.Entries() > 0 {
+				if err := c.compact(elev); err != nil {
+					log.Printf("Error compacting journal: %v\n", err)
+				}
+			}
 
-		case <-orderTimer.C:
-			startNextOrder(elev, nextOrder, orderChan, txChan)
+		case <-c.orderTimer.C():
+			if !c.stopping.active {
+				c.startNextOrder(elev, nextOrder)
+			}
+
+		case ord := <-c.buttonPressChan:
+			c.newButtonPress(ord)
+
+		case ord := <-c.networkOrderChan:
+			c.newNetworkMessage(ord, elev)
+
+		case hb := <-c.heartbeatChan:
+			if u, ok := c.tracker.Seen(hb.ID, c.clock.Now()); ok {
+				c.peerSeen(u, elev)
+			}
+
+		case req := <-c.requestChan:
+			c.answerStateRequest(req, elev)
 
-		case ord := <-buttonPressChan:
-			newButtonPress(ord, txChan)
+		case remote := <-c.syncChan:
+			c.restoreFromPeer(remote)
+			c.reconcile(remote, elev)
 
-		case ord := <-networkOrderChan:
-			newNetworkMessage(ord, orderChan)
+		case <-heartbeatTicker.C():
+			c.finishRestore(elev)
+			c.txQueue.Push(peers.Heartbeat{ID: c.cfg.ID})
+			if u, ok := c.tracker.Expire(c.clock.Now()); ok {
+				c.peersLost(u, elev)
+			}
+
+		case <-metricsTicker.C():
+			logging.Debugf("%s\n", c.txQueue.Metrics().ToString())
+
+		case s := <-c.settingsChan:
+			c.applySettings(s)
 
-		case <-time.After(checkTimestampInterval):
+		case <-timestampTicker.C():
 			timeoutChan := make(chan order.Order, elev.Nfloors*elev.Nbuttons)
-			elev.CheckOrderTimestamp(timeoutChan)
+			elev.CheckOrderTimestamp(c.clock.Now(), timeoutChan)
 			for len(timeoutChan) > 0 {
 				o := <-timeoutChan
 				o.Status = order.NotTaken
-				orderChan <- o
+				c.orderChan <- o
 			}
 
-			filebackup.Write(backupFileName, elev)
+		case sig := <-sigs:
+			c.beginShutdown(sig)
+
+		case <-c.shutdownTimer():
+			if !c.stopping.immediate {
+				log.Println("Not stopped at a floor in time.")
+				c.stopImmediately()
+			} else {
+				return c.finishShutdown(elev, elev, false)
+			}
 
-		case <-watchdog.Hungry():
-			watchdog.Feed()
+		case final := <-c.stoppedChan:
+			return c.finishShutdown(elev, final, true)
 
-		case sig := <-sigs:
-			log.Printf("Received signal: %s. Exiting...\n", sig.String())
-			return
+		case <-ctx.Done():
+			return c.abort(elev)
 		}
 	}
 }
@@ -0,0 +1,344 @@
+package control
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"../clock"
+	"../driver/elevio"
+	"../elevTypes/order"
+	"../events"
+	"../network/loopback"
+	"../request"
+	"../store"
+	"../watchdog"
+)
+
+const (
+	// How much the fake clock is advanced per step of the simulation, and
+	// how long to sleep between the steps so the goroutines keep up.
+	simStep  time.Duration = 10 * time.Millisecond
+	simSleep time.Duration = 500 * time.Microsecond
+	// How long to wait for something that should happen in the simulation.
+	waitTimeout time.Duration = 10 * time.Second
+	// The cars move a floor per second of the fake clock.
+	floorsPerSecond float64 = 1
+)
+
+// car is simulated elevator hardware. It moves speed floors per second while
+// the motor runs, see step, and reports the floors it passes to the floor
+// sensor poller. ups counts the times the motor was started upwards.
+type car struct {
+	mu      sync.Mutex
+	pos     float64
+	speed   float64
+	motor   elevio.MotorDirection
+	ups     int
+	door    bool
+	buttons chan elevio.ButtonEvent
+	floors  chan int
+}
+
+func newCar(pos float64) *car {
+	return &car{pos: pos, speed: floorsPerSecond, buttons: make(chan elevio.ButtonEvent, 4),
+		floors: make(chan int, 4)}
+}
+
+func (c *car) SetMotorDirection(dir elevio.MotorDirection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dir == elevio.MD_Up && c.motor != elevio.MD_Up {
+		c.ups++
+	}
+	c.motor = dir
+}
+func (c *car) SetButtonLamp(button elevio.ButtonType, floor int, value bool) {}
+func (c *car) SetFloorIndicator(floor int)                                   {}
+func (c *car) SetDoorOpenLamp(value bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.door = value
+}
+func (c *car) SetStopLamp(value bool) {}
+
+func (c *car) GetFloor() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.floor()
+}
+
+// floor returns the floor the car is at, or -1 between floors. Must be called
+// with c.mu held.
+func (c *car) floor() int {
+	if f := float64(int(c.pos + 0.5)); c.pos > f-1e-6 && c.pos < f+1e-6 {
+		return int(f)
+	}
+	return -1
+}
+
+func (c *car) PollButtons(ctx context.Context, receiver chan<- elevio.ButtonEvent) {
+	for {
+		select {
+		case b := <-c.buttons:
+			receiver <- b
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *car) PollFloorSensor(ctx context.Context, receiver chan<- int) {
+	for {
+		select {
+		case f := <-c.floors:
+			receiver <- f
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// step moves the car for d, and stops it at a floor it reaches.
+func (c *car) step(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.motor == elevio.MD_Stop {
+		return
+	}
+	old := c.pos
+	c.pos += float64(c.motor) * c.speed * d.Seconds()
+	// the next floor in the direction of the motor
+	next := math.Floor(old+1e-6) + 1
+	if c.motor == elevio.MD_Down {
+		next = math.Ceil(old-1e-6) - 1
+	}
+	if (c.motor == elevio.MD_Up && c.pos >= next-1e-6) ||
+		(c.motor == elevio.MD_Down && c.pos <= next+1e-6) {
+		c.pos = next
+		select {
+		case c.floors <- int(next):
+		default:
+		}
+	}
+}
+
+// at reports whether the car is stopped at floor, and whether its door is
+// open.
+func (c *car) at(floor int) (stopped, door bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.floor() == floor && c.motor == elevio.MD_Stop, c.door
+}
+
+// testElevator is a controller running on a car.
+type testElevator struct {
+	car  *car
+	sigs chan os.Signal
+	done chan int
+
+	mu      sync.Mutex
+	claimed []order.Order
+	status  map[[2]int]order.Status
+}
+
+// start runs a controller for each elevator id on its car, on a perfect
+// loopback network. The fake clock and the cars are advanced until the test
+// ends.
+func start(t *testing.T, cars map[string]*car) map[string]*testElevator {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	hub := loopback.NewHub(1)
+	simCtx, stopSim := context.WithCancel(context.Background())
+	simDone := make(chan struct{})
+	t.Cleanup(func() {
+		stopSim()
+		<-simDone
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	elevs := make(map[string]*testElevator)
+	for id, car := range cars {
+		e := &testElevator{car: car, sigs: make(chan os.Signal, 1),
+			done: make(chan int, 1), status: make(map[[2]int]order.Status)}
+		bus := events.NewBus()
+		bus.Observe(e.record, events.OrderClaimed, events.ElevatorChanged)
+		// a penalty far above the backoff, so the closest elevator always
+		// claims first
+		cfg := Config{ID: id, Nfloors: 4, Nbuttons: 3,
+			Settings: Settings{DistancePenalty: time.Second}}
+		c, err := New(cfg, Dependencies{IO: e.car, Network: hub.Node(id),
+			Store: store.NewMemory(), Scheduler: &request.Scheduler{}, Clock: clk, Bus: bus})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			code, _ := c.Run(ctx, e.sigs)
+			e.done <- code
+		}()
+		elevs[id] = e
+	}
+	t.Cleanup(func() {
+		cancel()
+		for _, e := range elevs {
+			e.wait(t)
+		}
+	})
+
+	go func() {
+		defer close(simDone)
+		for simCtx.Err() == nil {
+			clk.Advance(simStep)
+			for _, e := range elevs {
+				e.car.step(simStep)
+			}
+			time.Sleep(simSleep)
+		}
+	}()
+	return elevs
+}
+
+// record keeps the claimed orders and the latest status of the hall orders.
+func (e *testElevator) record(ev events.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch ev.Kind {
+	case events.OrderClaimed:
+		e.claimed = append(e.claimed, ev.Order)
+	case events.ElevatorChanged:
+		for f := range ev.Elevator.Orders {
+			for typ, o := range ev.Elevator.Orders[f] {
+				e.status[[2]int{f, typ}] = o.Status
+			}
+		}
+	}
+}
+
+// claims returns how many times the elevator claimed the order at floor.
+func (e *testElevator) claims(floor int, typ order.Type) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for _, o := range e.claimed {
+		if o.Floor == floor && o.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *testElevator) orderStatus(floor int, typ order.Type) order.Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status[[2]int{floor, int(typ)}]
+}
+
+func (e *testElevator) press(floor int, button elevio.ButtonType) {
+	e.car.buttons <- elevio.ButtonEvent{Floor: floor, Button: button}
+}
+
+// wait returns the exit code of the controller.
+func (e *testElevator) wait(t *testing.T) int {
+	t.Helper()
+	select {
+	case code := <-e.done:
+		// the code is kept for a later wait
+		e.done <- code
+		return code
+	case <-time.After(waitTimeout):
+		t.Fatal("controller didn't return")
+		return 0
+	}
+}
+
+// waitFor fails the test unless cond becomes true within waitTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// servedAt returns a condition which is true when the car is stopped at floor
+// with the door open.
+func servedAt(c *car, floor int) func() bool {
+	return func() bool {
+		stopped, door := c.at(floor)
+		return stopped && door
+	}
+}
+
+func TestHallCallClaimedOnce(t *testing.T) {
+	elevs := start(t, map[string]*car{"a": newCar(0), "b": newCar(1)})
+	// pressed at a, b is closer
+	elevs["a"].press(3, elevio.BT_HallDown)
+
+	waitFor(t, "b to serve the call", servedAt(elevs["b"].car, 3))
+	waitFor(t, "both elevators to finish the order", func() bool {
+		return elevs["a"].orderStatus(3, order.HallDown) == order.Finished &&
+			elevs["b"].orderStatus(3, order.HallDown) == order.Finished
+	})
+	if n := elevs["a"].claims(3, order.HallDown); n != 0 {
+		t.Errorf("a claimed the order %d times, want 0", n)
+	}
+	if n := elevs["b"].claims(3, order.HallDown); n != 1 {
+		t.Errorf("b claimed the order %d times, want 1", n)
+	}
+	if stopped, _ := elevs["a"].car.at(0); !stopped {
+		t.Error("a left floor 0")
+	}
+}
+
+func TestShutdownHandsOverOrder(t *testing.T) {
+	elevs := start(t, map[string]*car{"a": newCar(0), "b": newCar(1)})
+	elevs["a"].press(3, elevio.BT_HallDown)
+	waitFor(t, "b to claim the order", func() bool {
+		return elevs["b"].claims(3, order.HallDown) == 1
+	})
+	waitFor(t, "b to leave floor 1", func() bool {
+		stopped, _ := elevs["b"].car.at(1)
+		return !stopped
+	})
+
+	elevs["b"].sigs <- os.Interrupt
+	if code := elevs["b"].wait(t); code != watchdog.ExitStopped {
+		t.Errorf("b exited with %d, want %d", code, watchdog.ExitStopped)
+	}
+	if stopped, _ := elevs["b"].car.at(2); !stopped {
+		t.Error("b didn't stop at floor 2, the next floor")
+	}
+
+	waitFor(t, "a to serve the call", servedAt(elevs["a"].car, 3))
+	if n := elevs["a"].claims(3, order.HallDown); n != 1 {
+		t.Errorf("a claimed the order %d times, want 1", n)
+	}
+}
+
+func TestSignalBeforeReady(t *testing.T) {
+	// stuck between floors, so the driver never finds one
+	c := newCar(0.5)
+	c.speed = 0
+	elevs := start(t, map[string]*car{"a": c})
+	waitFor(t, "a to search for a floor", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.motor == elevio.MD_Down
+	})
+
+	elevs["a"].sigs <- os.Interrupt
+	if code := elevs["a"].wait(t); code != watchdog.ExitStopped {
+		t.Errorf("exited with %d, want %d", code, watchdog.ExitStopped)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.motor != elevio.MD_Stop || c.ups != 0 {
+		t.Errorf("motor %d and started upwards %d times, want it stopped while "+
+			"searching down", c.motor, c.ups)
+	}
+}
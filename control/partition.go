@@ -0,0 +1,198 @@
+package control
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+	"../events"
+	"../network/peers"
+)
+
+const (
+	// How often to broadcast a heartbeat.
+	heartbeatInterval time.Duration = 200 * time.Millisecond
+	// How long without a heartbeat before a peer is considered lost.
+	peerTimeout time.Duration = 2 * time.Second
+)
+
+// StateSync is broadcast when a peer (re)appears so that both sides of a
+// healed partition can reconcile their hall orders.
+type StateSync struct {
+	ID          string
+	ActiveOrder order.Order
+	// Hall is the hall orders that have a status, with their floor and type
+	// set. Cab orders and the rest of the elevator aren't reconciled, so
+	// they're left out to keep the message small.
+	Hall []order.Order
+}
+
+// StateRequest is broadcast by an elevator that has just started, asking the
+// peers to send their StateSync. Peers only send it on their own when they
+// see a new peer, and an elevator restarted within peerTimeout is never lost.
+type StateRequest struct {
+	ID string
+}
+
+// newStateSync returns the state of elev to send to peers.
+func newStateSync(id string, elev elevator.Elevator) StateSync {
+	s := StateSync{ID: id, ActiveOrder: elev.ActiveOrder}
+	for f := range elev.Orders {
+		for t := order.HallUp; t <= order.HallDown && int(t) < len(elev.Orders[f]); t++ {
+			o := elev.Orders[f][t]
+			if o.Status == order.Invalid {
+				continue
+			}
+			o.Floor, o.Type = f, t
+			s.Hall = append(s.Hall, o)
+		}
+	}
+	return s
+}
+
+// hallOrder returns the hall order at floor f of type t reported by the peer.
+// Its status is Invalid if the peer didn't report it.
+func (s StateSync) hallOrder(f int, t order.Type) order.Order {
+	for _, o := range s.Hall {
+		if o.Floor == f && o.Type == t {
+			return o
+		}
+	}
+	return order.Order{Floor: f, Type: t, Status: order.Invalid}
+}
+
+// peersMissing reports whether any lost peer hasn't been seen again. It's
+// informational, used to log when degraded mode ends. Degraded mode itself
+// is the hall orders released when the peers are lost, see peersLost.
+func (c *Controller) peersMissing() bool {
+	return len(c.lostPeers) > 0
+}
+
+// outstanding reports whether an order with status s still has to be served.
+func outstanding(s order.Status) bool {
+	return s == order.NotTaken || s == order.Taken || s == order.Execute
+}
+
+// peersLost enters degraded mode. All hall orders taken by other elevators
+// are released locally, since the elevator holding them may be on the other
+// side of the partition.
+func (c *Controller) peersLost(u peers.Update, elev elevator.Elevator) {
+	for _, id := range u.Lost {
+		c.lostPeers[id] = true
+		c.publish(events.Event{Kind: events.PeerLost, Peer: id})
+	}
+	log.Printf("Lost peers %s. Reachable peers: [%s]. Entering degraded mode, "+
+		"serving all known hall orders.\n",
+		strings.Join(u.Lost, ", "), strings.Join(u.Peers, ", "))
+
+	for f := range elev.Orders {
+		for t := order.HallUp; t <= order.HallDown; t++ {
+			o := elev.Orders[f][t]
+			if o.Status == order.Taken && !order.CompareFloorAndType(o, elev.ActiveOrder) {
+				o.Status = order.NotTaken
+				c.orderChan <- o
+			}
+		}
+	}
+}
+
+// peerSeen handles a peer that is new or came back after being lost. The
+// current state is sent so that the peer can reconcile.
+func (c *Controller) peerSeen(u peers.Update, elev elevator.Elevator) {
+	if c.lostPeers[u.New] {
+		delete(c.lostPeers, u.New)
+		log.Printf("Peer %s is back. Reachable peers: [%s].\n",
+			u.New, strings.Join(u.Peers, ", "))
+		if !c.peersMissing() {
+			log.Println("All lost peers are back. Leaving degraded mode.")
+		}
+	} else {
+		log.Printf("New peer %s. Reachable peers: [%s].\n",
+			u.New, strings.Join(u.Peers, ", "))
+	}
+	c.publish(events.Event{Kind: events.PeerSeen, Peer: u.New})
+
+	c.txQueue.Push(newStateSync(c.cfg.ID, elev))
+}
+
+// requestState asks the peers for their state, so that hall orders and the
+// persisted active order can be checked against them, see restoreFromPeer.
+// The restore window starts now, since the answers can't arrive before.
+func (c *Controller) requestState() {
+	if c.restoring.active {
+		c.restoring.deadline = c.clock.Now().Add(restoreWindow)
+	}
+	c.txQueue.Push(StateRequest{ID: c.cfg.ID})
+}
+
+// answerStateRequest sends the state of elev to a peer that asked for it.
+func (c *Controller) answerStateRequest(req StateRequest, elev elevator.Elevator) {
+	if req.ID == c.cfg.ID {
+		return
+	}
+	log.Printf("Peer %s asked for our state.\n", req.ID)
+	c.txQueue.Push(newStateSync(c.cfg.ID, elev))
+}
+
+// mergeHallOrders merges the hall orders of a peer into the local matrix and
+// returns the orders that must change locally. Orders that are outstanding on
+// either side stay outstanding, so no hall call is lost, unless this elevator
+// finished the order after the peer's cell was stamped, see order.Order. If
+// both elevators are executing the same hall order the one with the lowest ID
+// keeps it. id is the ID of this elevator.
+func mergeHallOrders(id string, elev elevator.Elevator, remote StateSync) []order.Order {
+	var changed []order.Order
+	for f := range elev.Orders {
+		for t := order.HallUp; t <= order.HallDown; t++ {
+			local := elev.Orders[f][t]
+			local.Floor, local.Type = f, t
+			r := remote.hallOrder(f, t)
+
+			mine := elev.ActiveOrder.Status == order.Taken &&
+				order.CompareFloorAndType(local, elev.ActiveOrder)
+			theirs := remote.ActiveOrder.Status == order.Taken &&
+				order.CompareFloorAndType(r, remote.ActiveOrder)
+
+			switch {
+			case mine && theirs:
+				if remote.ID < id {
+					log.Printf("Peer %s also executes %s and has lower ID. "+
+						"Releasing it.\n", remote.ID, local.ToString())
+					local.Status = order.Taken
+					changed = append(changed, local)
+				}
+			case mine:
+				// keep serving it
+			case theirs:
+				if local.Status != order.Taken {
+					local.Status = order.Taken
+					changed = append(changed, local)
+				}
+			case local.Status == order.Finished &&
+				local.LocalTimeStamp > r.LocalTimeStamp:
+				// finished here since the peer's order was pressed or
+				// taken
+			case !outstanding(local.Status) && outstanding(r.Status):
+				local.Status, local.LocalTimeStamp = r.Status, r.LocalTimeStamp
+				if local.Status == order.Execute {
+					local.Status = order.NotTaken
+				}
+				changed = append(changed, local)
+			}
+		}
+	}
+	return changed
+}
+
+// reconcile applies the state of a peer to the local elevator.
+func (c *Controller) reconcile(remote StateSync, elev elevator.Elevator) {
+	changed := mergeHallOrders(c.cfg.ID, elev, remote)
+	log.Printf("Reconciled with peer %s, %d hall orders changed.\n",
+		remote.ID, len(changed))
+	c.publish(events.Event{Kind: events.Reconciled, Peer: remote.ID, Count: len(changed)})
+	for _, o := range changed {
+		c.orderChan <- o
+	}
+}
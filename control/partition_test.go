@@ -0,0 +1,89 @@
+package control
+
+import (
+	"testing"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+)
+
+func TestMergeHallOrders(t *testing.T) {
+	// the cells compared are the HallUp order at floor 2 on both sides, with
+	// the given status and stamp. A side executing it has it as its active
+	// order. This elevator is b
+	const f, typ = 2, order.HallUp
+	cell := func(status order.Status, stamp int64) order.Order {
+		return order.Order{Floor: f, Type: typ, Status: status, LocalTimeStamp: stamp}
+	}
+	tests := []struct {
+		name         string
+		local        order.Order
+		localActive  bool
+		remoteID     string
+		remote       order.Order
+		remoteActive bool
+		// the new local status, Invalid if it's unchanged
+		want order.Status
+	}{
+		{"pressed at the peer", cell(order.Invalid, 0), false,
+			"c", cell(order.NotTaken, 100), false, order.NotTaken},
+		{"executed by the peer but unknown here", cell(order.Invalid, 0), false,
+			"c", cell(order.Execute, 100), false, order.NotTaken},
+		{"finished here after the peer's press", cell(order.Finished, 200), false,
+			"c", cell(order.NotTaken, 100), false, order.Invalid},
+		{"pressed at the peer after finishing here", cell(order.Finished, 100), false,
+			"c", cell(order.NotTaken, 200), false, order.NotTaken},
+		{"pressed at the peer in the second it's finished", cell(order.Finished, 100), false,
+			"c", cell(order.NotTaken, 100), false, order.NotTaken},
+		{"finished here after the peer's take", cell(order.Finished, 200), false,
+			"c", cell(order.Taken, 110), false, order.Invalid},
+		{"taken by the peer after finishing here", cell(order.Finished, 100), false,
+			"c", cell(order.Taken, 210), false, order.Taken},
+		{"finished at the peer", cell(order.NotTaken, 100), false,
+			"c", cell(order.Finished, 200), false, order.Invalid},
+		{"finished on both sides", cell(order.Finished, 100), false,
+			"c", cell(order.Finished, 200), false, order.Invalid},
+		{"taken by both, the peer has a lower ID", cell(order.Taken, 110), true,
+			"a", cell(order.Taken, 120), true, order.Taken},
+		{"taken by both, the peer has a higher ID", cell(order.Taken, 110), true,
+			"c", cell(order.Taken, 120), true, order.Invalid},
+		{"executed by the peer, NotTaken here", cell(order.NotTaken, 100), false,
+			"c", cell(order.Taken, 110), true, order.Taken},
+		{"executed by the peer, Taken here", cell(order.Taken, 110), false,
+			"c", cell(order.Taken, 110), true, order.Invalid},
+		{"NotTaken here, Taken by someone else at the peer", cell(order.NotTaken, 100), false,
+			"c", cell(order.Taken, 110), false, order.Invalid},
+		{"Taken here, NotTaken at the peer", cell(order.Taken, 110), false,
+			"c", cell(order.NotTaken, 100), false, order.Invalid},
+		{"executed here, NotTaken at the peer", cell(order.Taken, 110), true,
+			"c", cell(order.NotTaken, 100), false, order.Invalid},
+	}
+
+	for _, tt := range tests {
+		elev := elevator.NewElevator(4, 3)
+		elev.Orders[f][typ] = tt.local
+		if tt.localActive {
+			elev.ActiveOrder = tt.local
+		}
+		remote := StateSync{ID: tt.remoteID, Hall: []order.Order{tt.remote}}
+		if tt.remoteActive {
+			remote.ActiveOrder = tt.remote
+		}
+
+		changed := mergeHallOrders("b", elev, remote)
+		if tt.want == order.Invalid {
+			if len(changed) != 0 {
+				t.Errorf("%s: changed %v, want nothing", tt.name, changed)
+			}
+			continue
+		}
+		if len(changed) != 1 || changed[0].Floor != f || changed[0].Type != typ ||
+			changed[0].Status != tt.want {
+			t.Errorf("%s: changed %v, want the order at floor %d changed to %d",
+				tt.name, changed, f, tt.want)
+		} else if tt.want == order.NotTaken && changed[0].LocalTimeStamp != tt.remote.LocalTimeStamp {
+			t.Errorf("%s: reopened order stamped %d, want the peer's %d",
+				tt.name, changed[0].LocalTimeStamp, tt.remote.LocalTimeStamp)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package control
+
+import (
+	"log"
+	"time"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+)
+
+const (
+	// How long to collect state from peers, counted from when it's asked for
+	// with a StateRequest, before deciding whether to resume the persisted
+	// active order. The request and the answers are each spread over 100 ms
+	// of copies, and peers may be busy for up to a heartbeat round, so this
+	// leaves room for more than one round past that.
+	restoreWindow time.Duration = 1 * time.Second
+)
+
+// restoreState is the persisted active order while it's being validated.
+type restoreState struct {
+	pending  order.Order
+	active   bool
+	deadline time.Time
+	// reason the pending order is dropped, empty if it should be resumed
+	dropReason string
+	// status to give the order in the matrix if it's dropped
+	dropStatus order.Status
+}
+
+// prepareRestore removes the active order and motion from a persisted
+// elevator, so the driver starts by finding a floor, and holds the active
+// order back until it's validated by validateRestore and finishRestore.
+func (c *Controller) prepareRestore(elev elevator.Elevator) elevator.Elevator {
+	o := elev.ActiveOrder
+	elev.ActiveOrder = order.Order{Status: order.Finished}
+	elev.Direction = elevator.Stop
+	elev.State = elevator.Init
+
+	if reason := validateRestore(o, elev); reason != "" {
+		log.Printf("Not resuming persisted active order %s: %s\n", o.ToString(), reason)
+		return elev
+	}
+
+	c.restoring = restoreState{
+		pending:  o,
+		active:   true,
+		deadline: c.clock.Now().Add(restoreWindow),
+	}
+	log.Printf("Holding persisted active order %s until peers have reported.\n", o.ToString())
+	return elev
+}
+
+// validateRestore checks a persisted active order against the elevator it
+// belongs to. Returns why it can't be resumed, or an empty string.
+func validateRestore(o order.Order, elev elevator.Elevator) string {
+	if o.Status != order.Taken && o.Status != order.Execute {
+		return "it's not active"
+	}
+	if o.Floor < 0 || o.Floor >= elev.Nfloors ||
+		o.Type < order.HallUp || o.Type > order.Cab {
+		return "it's outside the order matrix"
+	}
+	return ""
+}
+
+// restoreFromPeer checks what a peer reports about the pending hall order.
+// Cab orders belong to this elevator only and are always resumed.
+func (c *Controller) restoreFromPeer(remote StateSync) {
+	if !c.restoring.active || c.restoring.dropReason != "" ||
+		c.restoring.pending.Type == order.Cab {
+		return
+	}
+	o := c.restoring.pending
+	if remote.ActiveOrder.Status == order.Taken &&
+		order.CompareFloorAndType(remote.ActiveOrder, o) {
+		c.restoring.dropReason = "peer " + remote.ID + " is executing it"
+		c.restoring.dropStatus = order.Taken
+		return
+	}
+	if remote.hallOrder(o.Floor, o.Type).Status == order.Finished {
+		c.restoring.dropReason = "peer " + remote.ID + " has finished it"
+		c.restoring.dropStatus = order.Finished
+	}
+}
+
+// finishRestore resumes or drops the pending order once the restore window
+// has passed and the car is standing at a floor.
+func (c *Controller) finishRestore(elev elevator.Elevator) {
+	if !c.restoring.active || c.clock.Now().Before(c.restoring.deadline) ||
+		elev.State != elevator.Idle {
+		return
+	}
+	c.restoring.active = false
+
+	o := c.restoring.pending
+	if c.restoring.dropReason != "" {
+		log.Printf("Not resuming persisted active order %s: %s\n",
+			o.ToString(), c.restoring.dropReason)
+		o.Status = c.restoring.dropStatus
+		c.orderChan <- o
+		return
+	}
+
+	log.Printf("Resuming persisted active order %s\n", o.ToString())
+	o.Status = order.Execute
+	c.orderChan <- o
+}
@@ -0,0 +1,136 @@
+package control
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"../clock"
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+	"../watchdog"
+)
+
+const (
+	// How long the driver has to stop at the next floor before the motor is
+	// stopped immediately. Longer than the driver's floor change timeout.
+	shutdownTimeout time.Duration = 8 * time.Second
+	// How long to wait for the driver after an immediate stop before giving
+	// up on it.
+	forceStopTimeout time.Duration = 1 * time.Second
+	// How long to let the transmitter send the last messages before exiting.
+	shutdownFlushTime time.Duration = 200 * time.Millisecond
+)
+
+// shutdownState is the progress of a shutdown started by a signal.
+type shutdownState struct {
+	active    bool
+	immediate bool
+	timer     clock.Timer
+}
+
+// shutdownTimer returns a channel which is filled when the current step of
+// the shutdown has taken too long. It's nil if no shutdown is in progress.
+func (c *Controller) shutdownTimer() <-chan time.Time {
+	if !c.stopping.active {
+		return nil
+	}
+	return c.stopping.timer.C()
+}
+
+// beginShutdown asks the driver to stop at the next floor on the first signal,
+// and to stop immediately on the second.
+func (c *Controller) beginShutdown(sig os.Signal) {
+	if !c.stopping.active {
+		log.Printf("Received signal: %s. Stopping at the next floor, "+
+			"send it again to stop immediately...\n", sig.String())
+		watchdog.Stopping()
+		c.stopping = shutdownState{active: true, timer: c.clock.NewTimer(shutdownTimeout)}
+		c.stopChan <- false
+		return
+	}
+	log.Printf("Received signal: %s again. Stopping immediately...\n", sig.String())
+	c.stopImmediately()
+}
+
+// stopBeforeReady stops the car immediately on a signal received while the
+// driver is still finding a floor, since there's no floor it knows to stop at.
+func (c *Controller) stopBeforeReady(sig os.Signal) {
+	if c.stopping.active {
+		return
+	}
+	log.Printf("Received signal: %s before the driver is ready. Stopping immediately...\n",
+		sig.String())
+	watchdog.Stopping()
+	c.stopping = shutdownState{active: true, timer: c.clock.NewTimer(forceStopTimeout)}
+	c.stopImmediately()
+}
+
+// stopImmediately asks the driver to stop the motor right away.
+func (c *Controller) stopImmediately() {
+	if c.stopping.immediate {
+		return
+	}
+	c.stopping.immediate = true
+	c.stopping.timer.Reset(forceStopTimeout)
+	c.stopChan <- true
+}
+
+// releaseHeld tells the other elevators that a hall order released by the
+// driver while stopping can be taken by someone else.
+func (c *Controller) releaseHeld(elev, newElev elevator.Elevator) {
+	o := elev.ActiveOrder
+	if o.Status == order.Taken && o.Type != order.Cab &&
+		newElev.ActiveOrder.Status == order.Invalid &&
+		order.CompareFloorAndType(o, newElev.ActiveOrder) {
+		o.Status = order.NotTaken
+		log.Printf("Releasing order %s to the network\n", o.ToString())
+		c.txQueue.Push(o)
+	}
+}
+
+// finishShutdown writes the final state of the stopped elevator and returns
+// the exit code. final is the state the driver stopped in, or elev if the
+// driver didn't stop in time.
+func (c *Controller) finishShutdown(elev, final elevator.Elevator, driverStopped bool) int {
+	code := watchdog.ExitStopped
+	if driverStopped {
+		c.releaseHeld(elev, final)
+	} else {
+		log.Println("Driver didn't stop in time, exiting without it.")
+		code = watchdog.ExitRestart
+	}
+
+	c.changeElevator(elev, final)
+	if err := c.compact(final); err != nil {
+		log.Printf("Error compacting journal: %v\n", err)
+		code = watchdog.ExitRestart
+	}
+	if err := c.journal.Close(); err != nil {
+		log.Printf("Error closing journal: %v\n", err)
+	}
+	if err := c.store.Close(); err != nil {
+		log.Printf("Error closing store: %v\n", err)
+	}
+
+	<-c.clock.After(shutdownFlushTime)
+	log.Printf("Shutdown finished with exit code %d\n", code)
+	return code
+}
+
+// abort saves elev and closes the journal and store when the controller is
+// cancelled without being shut down. The car is left where it is, so the exit
+// code is always ExitRestart.
+func (c *Controller) abort(elev elevator.Elevator) int {
+	log.Println("Controller cancelled, exiting without stopping the driver.")
+	if err := c.compact(elev); err != nil {
+		log.Printf("Error compacting journal: %v\n", err)
+	}
+	if err := c.journal.Close(); err != nil {
+		log.Printf("Error closing journal: %v\n", err)
+	}
+	if err := c.store.Close(); err != nil {
+		log.Printf("Error closing store: %v\n", err)
+	}
+	return watchdog.ExitRestart
+}
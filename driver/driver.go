@@ -1,21 +1,70 @@
 package driver
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"sync"
 	"time"
 
+	"../clock"
 	"../elevTypes/elevator"
 	"../elevTypes/order"
+	"../events"
+	"../health"
+	"../logging"
 	"./elevio"
+	"./fsm"
+	"./safety"
 )
 
+// Timing is the timeouts used by the driver.
+type Timing struct {
+	// Door is how long the door stays open at a floor.
+	Door time.Duration
+	// FloorChange is how long the car can drive without reaching a floor
+	// before the motor is considered failed.
+	FloorChange time.Duration
+	// FindFloor is how long to drive in one direction looking for a floor at
+	// startup.
+	FindFloor time.Duration
+	// Order is how long an order can be Taken before it must be finished.
+	// It's rounded to whole seconds.
+	Order time.Duration
+}
+
+// DefaultTiming is the timing used by default.
+var DefaultTiming = Timing{
+	Door:        3 * time.Second,
+	FloorChange: 5 * time.Second,
+	FindFloor:   5 * time.Second,
+	Order:       time.Duration(order.OrderTimeout) * time.Second,
+}
+
 const (
-	floorChangeTimeout time.Duration = 5 * time.Second
-	doorTimeout        time.Duration = 3 * time.Second
+	// How often the driver loop reports progress when there are no events.
+	healthInterval time.Duration = 250 * time.Millisecond
+	// The driver loop wakes up at least every healthInterval, so it's stuck
+	// if it hasn't made progress for this long.
+	healthTimeout time.Duration = 1 * time.Second
 )
 
-func setLamps(elev elevator.Elevator) {
+// IO is the elevator hardware, implemented by elevio.Conn.
+type IO interface {
+	SetMotorDirection(dir elevio.MotorDirection)
+	SetButtonLamp(button elevio.ButtonType, floor int, value bool)
+	SetFloorIndicator(floor int)
+	SetDoorOpenLamp(value bool)
+	SetStopLamp(value bool)
+	GetFloor() int
+	PollButtons(ctx context.Context, receiver chan<- elevio.ButtonEvent)
+	PollFloorSensor(ctx context.Context, receiver chan<- int)
+}
+
+// HealthName is the name the driver loop reports progress under, see the
+// health package. It's given to health.Name with the ID of the elevator.
+const HealthName = "driver"
+
+func setLamps(hw IO, elev elevator.Elevator) {
 	for i := range elev.Orders {
 		for j := range elev.Orders[i] {
 			set := false
@@ -25,19 +74,28 @@ func setLamps(elev elevator.Elevator) {
 				status == order.Execute {
 				set = true
 			}
-			elevio.SetButtonLamp(elevio.ButtonType(j), i, set)
+			hw.SetButtonLamp(elevio.ButtonType(j), i, set)
 		}
 	}
 }
 
-func orderFromMain(elev elevator.Elevator, ord order.Order) (elevator.Elevator, bool) {
+func orderFromMain(elev elevator.Elevator, ord order.Order,
+	now time.Time, timeout time.Duration) (elevator.Elevator, bool) {
 	switch ord.Status {
 	case order.Taken:
-		ord.LocalTimeStamp = time.Now().Unix() + order.OrderTimeout
+		ord.LocalTimeStamp = now.Add(timeout).Unix()
+		if ord.Type != order.Cab && elev.ActiveOrder.Status == order.Taken &&
+			order.CompareFloorAndType(ord, elev.ActiveOrder) {
+			// Another elevator has won this order, stop serving it.
+			log.Printf("Releasing active order %s\n", elev.ActiveOrder.ToString())
+			elev.ActiveOrder.Status = order.Invalid
+		}
 
 	case order.Execute:
-		ord.LocalTimeStamp = time.Now().Unix() + order.OrderTimeout
-		if elev.ActiveOrder.Status != order.Finished && !order.CompareEq(ord, elev.ActiveOrder) {
+		ord.LocalTimeStamp = now.Add(timeout).Unix()
+		if elev.ActiveOrder.Status != order.Finished &&
+			elev.ActiveOrder.Status != order.Invalid &&
+			!order.CompareEq(ord, elev.ActiveOrder) {
 			oldActive := elev.ActiveOrder
 			oldActive.Status = order.NotTaken
 			elev.AssignOrderToMatrix(oldActive)
@@ -51,166 +109,584 @@ func orderFromMain(elev elevator.Elevator, ord order.Order) (elevator.Elevator,
 	return elev, true
 }
 
-// can only happen in state elevator.Moving
-func floorChange(elev elevator.Elevator, newFloor int,
-	motorTimer, doorTimer *time.Timer) (elevator.Elevator, bool) {
-	elevio.SetFloorIndicator(newFloor)
-	motorTimer.Reset(floorChangeTimeout)
+// hasActiveOrder reports whether the elevator has an order to drive to. The
+// car can be moving without one if the order was released.
+func hasActiveOrder(elev elevator.Elevator) bool {
+	return elev.ActiveOrder.Status == order.Taken
+}
 
-	elev.Floor = newFloor
-	if newFloor == elev.ActiveOrder.Floor {
-		if elev.ActiveOrder.Type != order.Cab {
-			elev.Orders[elev.ActiveOrder.Floor][order.Cab].Status = order.Finished
-		}
-		elev, _ = arrivedAtTarget(elev, motorTimer, doorTimer)
-	} else {
-		elev.State = elevator.Moving
+// fire updates the elevator after an event given to the state machine, or
+// logs why it was rejected. Reports whether the event was accepted.
+func (l *loop) fire(err error) bool {
+	if err != nil {
+		log.Printf("Rejected transition: %v\n", err)
+		return false
 	}
-	return elev, true
+	l.elev.State = l.m.State()
+	l.elev.Direction = l.m.Direction()
+	return true
 }
 
-func arrivedAtTarget(
-	elev elevator.Elevator,
-	motorTimer, doorTimer *time.Timer) (elevator.Elevator, bool) {
-	log.Println("Arrived at target floor.")
+// publish sends ev on the event bus, stamped with the current time.
+func (l *loop) publish(ev events.Event) {
+	ev.Time = l.clk.Now()
+	l.bus.Publish(ev)
+}
 
-	elevio.SetMotorDirection(elevio.MD_Stop)
-	motorTimer.Stop()
-	elev.Direction = elevator.Stop
+// findFloor reads the floor sensor at startup. If the car is at a floor the
+// driver is ready, otherwise it starts driving down so that it stops at the
+// first floor it reaches, see floorChange and searchTimeout.
+func (l *loop) findFloor() {
+	floor := l.hw.GetFloor()
+	if floor == -1 {
+		log.Println("Between floors at startup. Driving down to find a floor.")
+		l.search(elevator.Down)
+		return
+	}
 
-	elev.ActiveOrder.Status = order.Finished
-	elev.Orders[elev.ActiveOrder.Floor][elev.ActiveOrder.Type].Status = order.Finished
+	l.hw.SetFloorIndicator(floor)
+	l.elev.Floor = floor
+	l.publish(events.Event{Kind: events.FloorReached, Floor: floor})
+	l.fire(l.m.Halt())
+}
 
-	elevio.SetDoorOpenLamp(true)
-	doorTimer.Reset(doorTimeout)
-	elev.State = elevator.DoorOpen
-	log.Println("Door opening")
+// search drives in direction to find a floor at startup.
+func (l *loop) search(direction elevator.Direction) {
+	if l.fire(l.m.Start(direction)) {
+		l.hw.SetMotorDirection(elevio.MotorDirection(direction))
+		l.motorTimer.Reset(l.timing.FindFloor)
+	}
+}
 
-	return elev, true
+// searchTimeout drives up if no floor was found driving down at startup. If
+// none was found driving up either, the motor has failed and is stopped, since
+// there's no floor to recover at.
+func (l *loop) searchTimeout() bool {
+	if l.m.Direction() == elevator.Down {
+		log.Println("No floor found driving down. Driving up to find a floor.")
+		l.search(elevator.Up)
+		return true
+	}
+	log.Println("No floor found driving up either. Stopping the motor.")
+	l.hw.SetMotorDirection(elevio.MD_Stop)
+	l.publish(events.Event{Kind: events.FaultRaised, Fault: "no floor found"})
+	return l.fire(l.m.GiveUp())
+}
+
+// floorChange handles a new floor while the motor is running.
+func (l *loop) floorChange(newFloor int) bool {
+	l.hw.SetFloorIndicator(newFloor)
+	l.motorTimer.Reset(l.timing.FloorChange)
+	l.elev.Floor = newFloor
+	l.publish(events.Event{Kind: events.FloorReached, Floor: newFloor})
+
+	if l.m.State() == elevator.Error {
+		log.Println("Reached a floor, the motor works again.")
+		l.fire(l.m.Recover())
+	}
+	if !hasActiveOrder(l.elev) {
+		// active order was released while moving, or the car is finding a
+		// floor at startup. stop at this floor
+		l.halt()
+	} else if newFloor == l.elev.ActiveOrder.Floor {
+		if l.arrivedAtTarget() && l.elev.ActiveOrder.Type != order.Cab {
+			// the cell may never have been pressed, so its floor and type
+			// aren't set
+			cab := &l.elev.Orders[newFloor][order.Cab]
+			cab.Floor, cab.Type, cab.Status = newFloor, order.Cab, order.Finished
+			l.mon.Finished(*cab)
+			l.publish(events.Event{Kind: events.OrderFinished, Order: *cab})
+		}
+	}
+	return true
+}
+
+// halt stops the motor without opening the door.
+func (l *loop) halt() {
+	l.hw.SetMotorDirection(elevio.MD_Stop)
+	l.motorTimer.Stop()
+	l.fire(l.m.Halt())
+}
+
+func (l *loop) arrivedAtTarget() bool {
+	log.Println("Arrived at target floor.")
+	l.hw.SetMotorDirection(elevio.MD_Stop)
+	l.motorTimer.Stop()
+	if !l.fire(l.m.Arrive()) {
+		return false
+	}
+
+	// stamped with when it was finished, see order.Order
+	l.elev.ActiveOrder.Status = order.Finished
+	l.elev.ActiveOrder.LocalTimeStamp = l.clk.Now().Unix()
+	l.elev.Orders[l.elev.ActiveOrder.Floor][l.elev.ActiveOrder.Type] = l.elev.ActiveOrder
+	l.mon.Finished(l.elev.ActiveOrder)
+	l.publish(events.Event{Kind: events.OrderFinished, Order: l.elev.ActiveOrder})
+
+	l.hw.SetDoorOpenLamp(true)
+	l.doorTimer.Reset(l.timing.Door)
+	l.publish(events.Event{Kind: events.DoorOpened, Floor: l.elev.Floor})
+	return true
 }
 
+// buttonPress adds the order of press to elev, stamped with now, see
+// order.Order.
 func buttonPress(
 	elev elevator.Elevator,
-	press elevio.ButtonEvent) (elevator.Elevator, bool, order.Order) {
+	press elevio.ButtonEvent, now time.Time) (elevator.Elevator, bool, order.Order) {
 	f := press.Floor
 	t := order.Type(press.Button)
-	o := order.Order{Floor: f, Type: t, Status: order.NotTaken}
+	o := order.Order{Floor: f, Type: t, Status: order.NotTaken, LocalTimeStamp: now.Unix()}
 	elev.Orders[f][t] = o
 	return elev, true, o
 }
 
-func doorClose(elev elevator.Elevator, doorTimer *time.Timer) (elevator.Elevator, bool) {
-	doorTimer.Stop()
-	elevio.SetDoorOpenLamp(false)
-	elev.State = elevator.Idle
-
-	log.Println("Door closing")
-	return elev, true
+func (l *loop) doorClose() bool {
+	l.doorTimer.Stop()
+	if !l.fire(l.m.CloseDoor()) {
+		return false
+	}
+	l.hw.SetDoorOpenLamp(false)
+	l.publish(events.Event{Kind: events.DoorClosed, Floor: l.elev.Floor})
+	return true
 }
 
-func motorTimeout(elev elevator.Elevator) (elevator.Elevator, bool) {
+func (l *loop) motorTimeout() bool {
 	log.Println("Motor timed out!!")
-	elev.State = elevator.Error
-	return elev, true
+	l.publish(events.Event{Kind: events.FaultRaised, Fault: "motor timed out"})
+	return l.fire(l.m.Fail())
 }
 
-func setDirection(elev elevator.Elevator,
-	motorTimer, doorTimer *time.Timer) (elevator.Elevator, bool) {
-	var updateElev bool = false
-	var d elevio.MotorDirection
-	if elev.ActiveOrder.Floor > elev.Floor {
-		d = elevio.MD_Up
-	} else if elev.ActiveOrder.Floor < elev.Floor {
-		d = elevio.MD_Down
+// setDirection drives towards the active order, or opens the door if the car
+// is at its floor.
+func (l *loop) setDirection() bool {
+	if !hasActiveOrder(l.elev) {
+		// keep going until the next floor, see floorChange
+		return false
+	}
+
+	var d elevator.Direction
+	if l.elev.ActiveOrder.Floor > l.elev.Floor {
+		d = elevator.Up
+	} else if l.elev.ActiveOrder.Floor < l.elev.Floor {
+		d = elevator.Down
+	} else if l.m.State() == elevator.Moving {
+		// the car has just passed the floor, drive back to it
+		d = -l.m.Direction()
 	} else {
-		elev, updateElev = arrivedAtTarget(elev, motorTimer, doorTimer)
+		l.arrivedAtTarget()
+		return true
 	}
 
-	if elev.Direction != elevator.Direction(d) {
-		elevio.SetMotorDirection(d)
-		motorTimer.Reset(floorChangeTimeout)
+	if l.m.Direction() == d || !l.fire(l.m.Start(d)) {
+		return false
+	}
+	l.hw.SetMotorDirection(elevio.MotorDirection(d))
+	l.motorTimer.Reset(l.timing.FloorChange)
+	return true
+}
 
-		elev.Direction = elevator.Direction(d)
-		updateElev = true
+// stopRequest releases the active order so that the car stops at the next
+// floor, see floorChange. The order is put back in the matrix as NotTaken, so
+// it's served by someone else, or by this elevator after a restart. If
+// immediate, or the motor has failed, the motor is stopped right away.
+func (l *loop) stopRequest(immediate bool) bool {
+	if hasActiveOrder(l.elev) {
+		log.Printf("Stopping, releasing active order %s\n", l.elev.ActiveOrder.ToString())
+		o := l.elev.ActiveOrder
+		o.Status = order.NotTaken
+		l.elev.AssignOrderToMatrix(o)
+		l.elev.ActiveOrder.Status = order.Invalid
 	}
 
-	return elev, updateElev
+	state := l.m.State()
+	moving := state == elevator.Moving || state == elevator.Init
+	if (immediate && moving) || state == elevator.Error {
+		log.Println("Stopping motor immediately.")
+		l.halt()
+	}
+	return true
+}
+
+// turnOffLamps turns off every lamp except the floor indicator, which can't
+// be turned off.
+func turnOffLamps(hw IO, elev elevator.Elevator) {
+	for i := range elev.Orders {
+		for j := range elev.Orders[i] {
+			hw.SetButtonLamp(elevio.ButtonType(j), i, false)
+		}
+	}
+	hw.SetDoorOpenLamp(false)
+	hw.SetStopLamp(false)
 }
 
 // Initialized driver channels for low level communication
-// and starts goroutines for polling hardware.
-func driverInit(port int, drvButtons chan elevio.ButtonEvent, drvFloors chan int) (*time.Timer, *time.Timer) {
-	elevio.Init(fmt.Sprintf("localhost:%d", port), 4)
-	motorTimer := time.NewTimer(floorChangeTimeout)
-	doorTimer := time.NewTimer(doorTimeout)
+// and starts goroutines for polling hardware. The pollers run until ctx is
+// cancelled, and are added to wg.
+func driverInit(ctx context.Context, wg *sync.WaitGroup, clk clock.Clock, hw IO,
+	drvButtons chan elevio.ButtonEvent, drvFloors chan int) (clock.Timer, clock.Timer) {
+	motorTimer := clk.NewTimer(time.Second) // this init time doesn't matter
+	doorTimer := clk.NewTimer(time.Second)
 	motorTimer.Stop()
 	doorTimer.Stop()
 
-	go elevio.PollButtons(drvButtons)
-	go elevio.PollFloorSensor(drvFloors)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		hw.PollButtons(ctx, drvButtons)
+	}()
+	go func() {
+		defer wg.Done()
+		hw.PollFloorSensor(ctx, drvFloors)
+	}()
 
 	return motorTimer, doorTimer
 }
 
+// eventKind is the kind of an event the driver reacts to.
+type eventKind int
+
+const (
+	buttonPressed eventKind = 0
+	floorReached  eventKind = 1
+	orderReceived eventKind = 2
+	stopRequested eventKind = 3
+	doorTimedOut  eventKind = 4
+	motorTimedOut eventKind = 5
+	safetyTripped eventKind = 6
+)
+
+// event is something that happened to the driver, from the hardware, from
+// control, from the safety monitor or from one of its timers. Only the field
+// for its kind is set.
+type event struct {
+	kind      eventKind
+	press     elevio.ButtonEvent
+	floor     int
+	order     order.Order
+	immediate bool
+	violation safety.Violation
+}
+
+// loop is the state of a running driver. The state and direction of elev
+// are kept in sync with m, which they're only changed through.
+type loop struct {
+	hw     IO
+	clk    clock.Clock
+	timing Timing
+	// pending is new timing waiting for the next state change, see
+	// setTiming.
+	pending    *Timing
+	elev       elevator.Elevator
+	m          *fsm.Machine
+	mon        *safety.Monitor
+	bus        *events.Bus
+	motorTimer clock.Timer
+	doorTimer  clock.Timer
+	// stopping is set when control has asked the driver to stop.
+	stopping bool
+}
+
+// transition handles an event, and reports whether the elevator changed.
+type transition func(l *loop, ev event) bool
+
+// transitions says how the driver reacts to each event in each state. Events
+// missing for a state are ignored, e.g. a door timer firing after the motor
+// has failed. The state changes themselves are checked by fsm.Machine.
+var transitions = map[elevator.State]map[eventKind]transition{
+	// finding a floor at startup. Control isn't listening before the driver
+	// is ready, so buttons are ignored
+	elevator.Init: {
+		stopRequested: requestStop,
+		safetyTripped: tripSafety,
+		floorReached:  changeFloor,
+		motorTimedOut: searchTimeout,
+	},
+	elevator.Idle: {
+		buttonPressed: pressButton,
+		orderReceived: receiveOrder,
+		stopRequested: requestStop,
+		safetyTripped: tripSafety,
+		floorReached:  seeFloor,
+	},
+	elevator.Moving: {
+		buttonPressed: pressButton,
+		orderReceived: receiveOrder,
+		stopRequested: requestStop,
+		safetyTripped: tripSafety,
+		floorReached:  changeFloor,
+		motorTimedOut: failMotor,
+	},
+	elevator.DoorOpen: {
+		buttonPressed: pressButton,
+		orderReceived: receiveOrder,
+		stopRequested: requestStop,
+		safetyTripped: tripSafety,
+		floorReached:  seeFloor,
+		doorTimedOut:  closeDoor,
+	},
+	elevator.Error: {
+		buttonPressed: pressButton,
+		orderReceived: receiveOrder,
+		stopRequested: requestStop,
+		safetyTripped: tripSafety,
+		// the motor works again
+		floorReached: changeFloor,
+	},
+}
+
+// steps is run after every event, until the state doesn't change anymore. It
+// drives towards the active order, if there is one.
+var steps = map[elevator.State]func(l *loop) bool{
+	elevator.Idle:   (*loop).setDirection,
+	elevator.Moving: (*loop).setDirection,
+}
+
+func pressButton(l *loop, ev event) (changed bool) {
+	var o order.Order
+	l.elev, changed, o = buttonPress(l.elev, ev.press, l.clk.Now())
+	l.publish(events.Event{Kind: events.ButtonPressed, Floor: o.Floor, Order: o})
+	return
+}
+
+func receiveOrder(l *loop, ev event) (changed bool) {
+	if l.stopping && ev.order.Status == order.Execute {
+		// don't start new orders while stopping
+		ev.order.Status = order.NotTaken
+	}
+	l.elev, changed = orderFromMain(l.elev, ev.order, l.clk.Now(), l.timing.Order)
+	if ev.order.Status == order.Execute {
+		l.publish(events.Event{Kind: events.OrderAssigned, Order: l.elev.ActiveOrder})
+	}
+	return
+}
+
+func requestStop(l *loop, ev event) bool {
+	l.stopping = true
+	return l.stopRequest(ev.immediate)
+}
+
+// tripSafety gives up the active order after the safety monitor has stopped
+// the motor, like an immediate stop.
+func tripSafety(l *loop, ev event) bool {
+	log.Printf("Giving up after safety violation: %v\n", ev.violation)
+	l.publish(events.Event{Kind: events.FaultRaised, Fault: ev.violation.Error()})
+	return l.stopRequest(true)
+}
+
+func changeFloor(l *loop, ev event) bool {
+	return l.floorChange(ev.floor)
+}
+
+// seeFloor updates the floor while standing still, which happens when the
+// floor sensor is first read.
+func seeFloor(l *loop, ev event) bool {
+	l.hw.SetFloorIndicator(ev.floor)
+	changed := l.elev.Floor != ev.floor
+	l.elev.Floor = ev.floor
+	if changed {
+		l.publish(events.Event{Kind: events.FloorReached, Floor: ev.floor})
+	}
+	return changed
+}
+
+func closeDoor(l *loop, ev event) bool {
+	return l.doorClose()
+}
+
+func failMotor(l *loop, ev event) bool {
+	return l.motorTimeout()
+}
+
+func searchTimeout(l *loop, ev event) bool {
+	return l.searchTimeout()
+}
+
+// setTiming takes t into use at the next state change, or right away if the
+// car is idle, so the timers already running keep their timeouts.
+func (l *loop) setTiming(t Timing) {
+	l.pending = &t
+	if l.m.State() == elevator.Idle {
+		l.applyTiming()
+	}
+}
+
+// applyTiming takes the pending timing into use, if there is any. It's called
+// on every transition, before the timers of the new state are started.
+func (l *loop) applyTiming() {
+	if l.pending == nil {
+		return
+	}
+	l.timing = *l.pending
+	l.pending = nil
+	log.Printf("New timing in use from state %s: %+v\n", l.m.State(), l.timing)
+}
+
+// handle runs the transition for ev in the current state and settles, see
+// steps. It reports whether the elevator changed.
+func (l *loop) handle(ev event) bool {
+	t, ok := transitions[l.elev.State][ev.kind]
+	if !ok {
+		return false
+	}
+	changed := t(l, ev)
+	if l.settle() {
+		changed = true
+	}
+	return changed
+}
+
+// settle runs the steps of the current state until the state doesn't change,
+// and reports whether the elevator changed.
+func (l *loop) settle() bool {
+	changed := false
+	// a step either changes the state or is done, and there are no cycles
+	// between the steps, so this ends
+	for {
+		step, ok := steps[l.elev.State]
+		if !ok {
+			return changed
+		}
+		state := l.elev.State
+		if step(l) {
+			changed = true
+		}
+		if l.elev.State == state {
+			return changed
+		}
+	}
+}
+
 // Driver is the main function of the package. It reads the low level channels
-// and sends the information to a higher level.
+// and sends the information to a higher level. The first state is sent on
+// mainElevatorChan when the car has found a floor, see findFloor. After that
+// each event is handled as it arrives, see transitions, and the new state is
+// sent on mainElevatorChan if it has changed. What happens is also published on
+// bus. The hardware is watched by a safety.Monitor, see tripSafety. The driver
+// and the monitor report to the health registry under the elevator id, see
+// health.Name. All timing is done with clk, using the timeouts in timing until
+// new ones are received on timingChan, see setTiming. A value on stopChan makes
+// the driver stop the car, at the next floor or immediately if the value is
+// true. When the motor has stopped the lamps are turned off, the final state is
+// sent on stoppedChan and Driver returns. Driver also returns, without stopping
+// the car, when ctx is cancelled. The pollers have returned when Driver
+// returns.
 func Driver(
-	elevIOport int,
+	ctx context.Context,
+	id string,
+	clk clock.Clock,
+	hw IO,
+	bus *events.Bus,
+	timing Timing,
+	timingChan <-chan Timing,
 	nfloors, nbuttons int,
 	mainElevatorChan chan<- elevator.Elevator,
 	orderChan <-chan order.Order,
 	buttonPressChan chan<- order.Order,
+	stopChan <-chan bool,
+	stoppedChan chan<- elevator.Elevator,
 	initElev elevator.Elevator) {
 	drvButtons := make(chan elevio.ButtonEvent)
 	drvFloors := make(chan int)
-	motorTimer, doorTimer := driverInit(elevIOport, drvButtons, drvFloors)
-
-	var elev elevator.Elevator = initElev
-	mainElevatorChan <- elev
-	elevio.SetMotorDirection(elevio.MotorDirection(elev.Direction))
-
-	var updateElev bool = true
+	ctx, cancel := context.WithCancel(ctx)
+	var pollers sync.WaitGroup
+	defer pollers.Wait()
+	defer cancel()
+	mon := safety.NewMonitor(hw, id, nfloors)
+	defer mon.Close()
+	hw = mon
+	motorTimer, doorTimer := driverInit(ctx, &pollers, clk, hw, drvButtons, drvFloors)
+	healthName := health.Name(id, HealthName)
+	health.Register(healthName, healthTimeout)
+	defer health.Unregister(healthName)
+	healthTicker := clk.NewTicker(healthInterval)
+	defer healthTicker.Stop()
+
+	// the driver always starts by finding a floor, whatever state the
+	// elevator was in
+	initElev.State = elevator.Init
+	initElev.Direction = elevator.Stop
+	m, _ := fsm.New(initElev.State, initElev.Direction)
+	m.Observe(func(t fsm.Transition) { logging.Debugf("Transition: %s\n", t) })
+	l := &loop{hw: hw, clk: clk, timing: timing, elev: initElev, m: m, mon: mon,
+		bus: bus, motorTimer: motorTimer, doorTimer: doorTimer}
+	m.Observe(func(fsm.Transition) { l.applyTiming() })
+	l.findFloor()
+
+	var sent elevator.Elevator
+	ready := false
 	for {
+		if !ready && l.elev.State != elevator.Init {
+			// found a floor, or gave up. Tell control, which waits for the
+			// first state before starting
+			log.Printf("Driver ready in state %s at floor %d\n", l.elev.State, l.elev.Floor)
+			ready = true
+			l.settle()
+			setLamps(hw, l.elev)
+			sent = l.elev.Copy()
+			select {
+			case mainElevatorChan <- l.elev.Copy():
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		health.Beat(healthName)
+		var changed bool
 		select {
 		case press := <-drvButtons:
-			var o order.Order
-			elev, updateElev, o = buttonPress(elev, press)
-			buttonPressChan <- o
+			changed = l.handle(event{kind: buttonPressed, press: press})
+			if changed {
+				select {
+				case buttonPressChan <- l.elev.Orders[press.Floor][press.Button]:
+				case <-ctx.Done():
+					return
+				}
+			}
 
-		case newFloor := <-drvFloors:
-			elev, updateElev = floorChange(elev, newFloor, motorTimer, doorTimer)
+		case floor := <-drvFloors:
+			changed = l.handle(event{kind: floorReached, floor: floor})
 
 		case o := <-orderChan:
-			elev, updateElev = orderFromMain(elev, o)
+			changed = l.handle(event{kind: orderReceived, order: o})
 
-		case <-doorTimer.C:
-			elev, updateElev = doorClose(elev, doorTimer)
+		case immediate := <-stopChan:
+			changed = l.handle(event{kind: stopRequested, immediate: immediate})
 
-		case <-motorTimer.C:
-			elev, updateElev = motorTimeout(elev)
+		case <-doorTimer.C():
+			changed = l.handle(event{kind: doorTimedOut})
 
-		case <-time.After(1 * time.Millisecond):
-			if updateElev {
-				setLamps(elev)
+		case <-motorTimer.C():
+			changed = l.handle(event{kind: motorTimedOut})
 
-				mainElevatorChan <- elev
-				updateElev = false
-			}
+		case v := <-mon.Tripped():
+			changed = l.handle(event{kind: safetyTripped, violation: v})
 
-			switch elev.State {
-			case elevator.Idle:
-				if elev.ActiveOrder.Status == order.Taken {
-					// will come into effect at next iteration
-					elev.State = elevator.Moving
-					updateElev = true
-				}
-			case elevator.Moving:
-				elev, updateElev = setDirection(elev, motorTimer, doorTimer)
-			case elevator.DoorOpen:
-				// do nothing, everything happens in transition/on events
-			case elevator.Error:
-				// do nothing, will exit when motors start working again
+		case t := <-timingChan:
+			l.setTiming(t)
+
+		case <-healthTicker.C():
+
+		case <-ctx.Done():
+			return
+		}
+
+		if ready && changed && !l.elev.Equal(sent) {
+			setLamps(hw, l.elev)
+			sent = l.elev.Copy()
+			select {
+			case mainElevatorChan <- l.elev.Copy():
+			case <-ctx.Done():
+				return
 			}
 		}
+
+		if l.stopping && l.elev.State != elevator.Moving &&
+			l.elev.State != elevator.Init {
+			log.Println("Driver stopped.")
+			turnOffLamps(hw, l.elev)
+			stoppedChan <- l.elev.Copy()
+			return
+		}
 	}
 }
@@ -0,0 +1,315 @@
+package driver
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"../clock"
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+	"../events"
+	"./elevio"
+	"./fsm"
+	"./safety"
+)
+
+// fakeIO is elevator hardware where the car is at floor, or between floors
+// if it's -1. The button lamps that are lit are in lamps.
+type fakeIO struct {
+	floor int
+	motor elevio.MotorDirection
+	door  bool
+	lamps map[elevio.ButtonEvent]bool
+}
+
+func (f *fakeIO) SetMotorDirection(dir elevio.MotorDirection) { f.motor = dir }
+func (f *fakeIO) SetButtonLamp(button elevio.ButtonType, floor int, value bool) {
+	f.lamps[elevio.ButtonEvent{Floor: floor, Button: button}] = value
+}
+func (f *fakeIO) SetFloorIndicator(floor int) {}
+func (f *fakeIO) SetDoorOpenLamp(value bool)  { f.door = value }
+func (f *fakeIO) SetStopLamp(value bool)      {}
+func (f *fakeIO) GetFloor() int               { return f.floor }
+func (f *fakeIO) PollButtons(ctx context.Context, receiver chan<- elevio.ButtonEvent) {
+	<-ctx.Done()
+}
+func (f *fakeIO) PollFloorSensor(ctx context.Context, receiver chan<- int) { <-ctx.Done() }
+
+// newTestLoop returns a driver loop idle at floor, with the hardware behind a
+// safety monitor like in Driver.
+func newTestLoop(t *testing.T, floor int) (*loop, *fakeIO, *safety.Monitor) {
+	hw := &fakeIO{floor: floor, lamps: make(map[elevio.ButtonEvent]bool)}
+	mon := safety.NewMonitor(hw, "test", 4)
+	t.Cleanup(mon.Close)
+	clk := clock.NewFake(time.Unix(1000, 0))
+	motorTimer, doorTimer := clk.NewTimer(time.Second), clk.NewTimer(time.Second)
+	motorTimer.Stop()
+	doorTimer.Stop()
+
+	m, err := fsm.New(elevator.Idle, elevator.Stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elev := elevator.NewElevator(4, 3)
+	elev.State, elev.Floor = elevator.Idle, floor
+	l := &loop{hw: mon, clk: clk, timing: DefaultTiming, elev: elev, m: m, mon: mon,
+		bus: events.NewBus(), motorTimer: motorTimer, doorTimer: doorTimer}
+	mon.GetFloor() // the floor sensor is read at startup
+	return l, hw, mon
+}
+
+// handle gives ev to l and sets the lamps if the elevator changed, like
+// Driver.
+func handle(l *loop, ev event) {
+	if l.handle(ev) {
+		setLamps(l.hw, l.elev)
+	}
+}
+
+// arrive moves the car to floor and gives the driver the reading, like the
+// floor sensor poller.
+func arrive(l *loop, hw *fakeIO, floor int) {
+	hw.floor = floor
+	l.hw.GetFloor()
+	handle(l, event{kind: floorReached, floor: floor})
+}
+
+// advance moves the clock of l forward by d and handles the timers that
+// fired, like Driver.
+func advance(l *loop, d time.Duration) {
+	l.clk.(*clock.Fake).Advance(d)
+	for {
+		select {
+		case <-l.doorTimer.C():
+			handle(l, event{kind: doorTimedOut})
+		case <-l.motorTimer.C():
+			handle(l, event{kind: motorTimedOut})
+		default:
+			return
+		}
+	}
+}
+
+// lamp reports whether the lamp of the button is lit.
+func (f *fakeIO) lamp(floor int, typ order.Type) bool {
+	return f.lamps[elevio.ButtonEvent{Floor: floor, Button: elevio.ButtonType(typ)}]
+}
+
+func TestServeHallCall(t *testing.T) {
+	l, hw, mon := newTestLoop(t, 0)
+	sub := l.bus.Subscribe(16, events.OrderFinished)
+
+	o := order.Order{Floor: 2, Type: order.HallUp, Status: order.Execute}
+	l.handle(event{kind: orderReceived, order: o})
+	if hw.motor != elevio.MD_Up {
+		t.Fatalf("motor is %d after the order, want up", hw.motor)
+	}
+	hw.floor = -1
+	arrive(l, hw, 1)
+	arrive(l, hw, 2)
+
+	if l.elev.State != elevator.DoorOpen || hw.motor != elevio.MD_Stop || !hw.door {
+		t.Errorf("state %s, motor %d, door %v at the target, want DoorOpen, stopped "+
+			"and open", l.elev.State, hw.motor, hw.door)
+	}
+	if counts := mon.Counts(); len(counts) > 0 {
+		t.Errorf("safety violations serving a hall call: %v", counts)
+	}
+
+	sub.Close()
+	var finished []order.Order
+	for ev := range sub.C {
+		finished = append(finished, ev.Order)
+	}
+	want := []order.Order{
+		{Floor: 2, Type: order.HallUp, Status: order.Finished},
+		{Floor: 2, Type: order.Cab, Status: order.Finished},
+	}
+	if len(finished) != len(want) {
+		t.Fatalf("finished %d orders, want %d: %v", len(finished), len(want), finished)
+	}
+	for i := range want {
+		got := finished[i]
+		if got.Floor != want[i].Floor || got.Type != want[i].Type ||
+			got.Status != want[i].Status {
+			t.Errorf("finished order %d is %s, want %s", i, got.ToString(), want[i].ToString())
+		}
+	}
+	if hall := l.elev.Orders[0][order.HallUp]; hall.Status != order.Invalid {
+		t.Errorf("HallUp order at floor 0 changed to %s", hall.ToString())
+	}
+}
+
+func TestDoorTimeout(t *testing.T) {
+	l, hw, _ := newTestLoop(t, 0)
+	handle(l, event{kind: orderReceived,
+		order: order.Order{Floor: 1, Type: order.HallUp, Status: order.Execute}})
+	if !hw.lamp(1, order.HallUp) {
+		t.Error("HallUp lamp at floor 1 is off while the order is served")
+	}
+	hw.floor = -1
+	arrive(l, hw, 1)
+	if l.elev.State != elevator.DoorOpen || !hw.door || hw.lamp(1, order.HallUp) {
+		t.Fatalf("state %s, door %v and lamp %v at the target, want DoorOpen, open and off",
+			l.elev.State, hw.door, hw.lamp(1, order.HallUp))
+	}
+	if o := l.elev.Orders[1][order.HallUp]; o.LocalTimeStamp != l.clk.Now().Unix() {
+		t.Errorf("finished order stamped %d, want the time it was finished, %d",
+			o.LocalTimeStamp, l.clk.Now().Unix())
+	}
+
+	advance(l, DefaultTiming.Door-time.Millisecond)
+	if l.elev.State != elevator.DoorOpen || !hw.door {
+		t.Fatalf("state %s and door %v before the door time, want DoorOpen and open",
+			l.elev.State, hw.door)
+	}
+	advance(l, time.Millisecond)
+	if l.elev.State != elevator.Idle || hw.door || hw.motor != elevio.MD_Stop {
+		t.Errorf("state %s, door %v and motor %d after the door time, want Idle, "+
+			"closed and stopped", l.elev.State, hw.door, hw.motor)
+	}
+}
+
+func TestMotorTimeout(t *testing.T) {
+	l, hw, _ := newTestLoop(t, 0)
+	sub := l.bus.Subscribe(16, events.FaultRaised)
+	defer sub.Close()
+	handle(l, event{kind: orderReceived,
+		order: order.Order{Floor: 2, Type: order.Cab, Status: order.Execute}})
+	hw.floor = -1
+
+	advance(l, DefaultTiming.FloorChange-time.Millisecond)
+	if l.elev.State != elevator.Moving {
+		t.Fatalf("state %s before the floor change time, want Moving", l.elev.State)
+	}
+	advance(l, time.Millisecond)
+	if l.elev.State != elevator.Error {
+		t.Fatalf("state %s after the floor change time, want Error", l.elev.State)
+	}
+	select {
+	case ev := <-sub.C:
+		if ev.Fault != "motor timed out" {
+			t.Errorf("fault '%s', want the motor timing out", ev.Fault)
+		}
+	default:
+		t.Error("no fault published when the motor timed out")
+	}
+	if !hw.lamp(2, order.Cab) {
+		t.Error("cab lamp at floor 2 is off, the order isn't served yet")
+	}
+
+	// the motor works again when the car reaches a floor
+	arrive(l, hw, 1)
+	if l.elev.State != elevator.Moving || hw.motor != elevio.MD_Up {
+		t.Errorf("state %s and motor %d after reaching a floor, want Moving and up",
+			l.elev.State, hw.motor)
+	}
+}
+
+func TestOrderTimeout(t *testing.T) {
+	l, hw, _ := newTestLoop(t, 0)
+	// taken by another elevator
+	handle(l, event{kind: orderReceived,
+		order: order.Order{Floor: 2, Type: order.HallDown, Status: order.Taken}})
+	timedOut := func() []order.Order {
+		c := make(chan order.Order, l.elev.Nfloors*l.elev.Nbuttons)
+		l.elev.CheckOrderTimestamp(l.clk.Now(), c)
+		close(c)
+		var orders []order.Order
+		for o := range c {
+			orders = append(orders, o)
+		}
+		return orders
+	}
+
+	advance(l, DefaultTiming.Order-time.Second)
+	if orders := timedOut(); len(orders) != 0 {
+		t.Fatalf("orders timed out before the order time: %v", orders)
+	}
+	advance(l, time.Second)
+	orders := timedOut()
+	if len(orders) != 1 || orders[0].Floor != 2 || orders[0].Type != order.HallDown {
+		t.Fatalf("timed out orders %v, want the HallDown order at floor 2", orders)
+	}
+
+	// control gives a timed out order back as NotTaken
+	o := orders[0]
+	o.Status = order.NotTaken
+	handle(l, event{kind: orderReceived, order: o})
+	if status := l.elev.Orders[2][order.HallDown].Status; status != order.NotTaken {
+		t.Errorf("timed out order is %d, want NotTaken", status)
+	}
+	if !hw.lamp(2, order.HallDown) {
+		t.Error("HallDown lamp at floor 2 is off, the order is still to be served")
+	}
+	if l.elev.State != elevator.Idle || hw.motor != elevio.MD_Stop {
+		t.Errorf("state %s and motor %d, want Idle and stopped until control assigns "+
+			"the order", l.elev.State, hw.motor)
+	}
+}
+
+func TestSearchFails(t *testing.T) {
+	l, hw, _ := newTestLoop(t, -1)
+	m, err := fsm.New(elevator.Init, elevator.Stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.m, l.elev.State = m, elevator.Init
+	l.findFloor()
+	if hw.motor != elevio.MD_Down {
+		t.Fatalf("motor is %d between floors at startup, want down", hw.motor)
+	}
+
+	advance(l, DefaultTiming.FindFloor)
+	if l.elev.State != elevator.Init || hw.motor != elevio.MD_Up {
+		t.Fatalf("state %s and motor %d after searching down, want Init and up",
+			l.elev.State, hw.motor)
+	}
+	advance(l, DefaultTiming.FindFloor)
+	if l.elev.State != elevator.Error || hw.motor != elevio.MD_Stop ||
+		l.elev.Direction != elevator.Stop {
+		t.Errorf("state %s, motor %d and direction '%s' after searching both ways, "+
+			"want Error and stopped", l.elev.State, hw.motor, l.elev.Direction)
+	}
+}
+
+// cpuTime returns the CPU time used by the process so far.
+func cpuTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// BenchmarkDriverIdle measures the CPU used by a driver waiting for events on
+// the real clock. Each op is 10ms of idling, and cpu-% is the CPU time used
+// per wall time.
+func BenchmarkDriverIdle(b *testing.B) {
+	const idle time.Duration = 10 * time.Millisecond
+	hw := &fakeIO{floor: 0, lamps: make(map[elevio.ButtonEvent]bool)}
+	ctx, cancel := context.WithCancel(context.Background())
+	mainElevatorChan := make(chan elevator.Elevator, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Driver(ctx, "bench", clock.Real{}, hw, events.NewBus(), DefaultTiming, nil,
+			4, 3, mainElevatorChan, nil, nil, nil, nil, elevator.NewElevator(4, 3))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	<-mainElevatorChan
+
+	b.ResetTimer()
+	start, cpu := time.Now(), cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		time.Sleep(idle)
+	}
+	used, wall := cpuTime(b)-cpu, time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(100*used.Seconds()/wall.Seconds(), "cpu-%")
+}
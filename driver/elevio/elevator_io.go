@@ -1,18 +1,20 @@
 package elevio
 
+import "context"
 import "time"
 import "sync"
 import "net"
-import "fmt"
-
+import "io"
 
+import "../../health"
 
 const _pollRate = 20 * time.Millisecond
 
-var _initialized bool = false
-var _numFloors int = 4
-var _mtx sync.Mutex
-var _conn net.Conn
+// HealthName is the name the IO pollers report progress under, see the
+// health package and Dial. A poll only counts as progress if all reads
+// succeeded.
+const HealthName = "elevio"
+const _healthTimeout = 1 * time.Second
 
 type MotorDirection int
 
@@ -35,156 +37,219 @@ type ButtonEvent struct {
 	Button ButtonType
 }
 
+// Conn is a connection to one ElevatorServer/SimElevatorServer. Several
+// connections can be open at once, e.g. to run a fleet in one process, each
+// reporting to the health registry under its own name. The Poll functions run
+// until their context is cancelled.
+type Conn struct {
+	mtx        sync.Mutex
+	conn       net.Conn
+	numFloors  int
+	healthName string
+}
 
-
-
-
-
-func Init(addr string, numFloors int) {
-	if _initialized {
-		fmt.Println("Driver already initialized!")
-		return
-	}
-	_numFloors = numFloors
-	_mtx = sync.Mutex{}
-	var err error
-	_conn, err = net.Dial("tcp", addr)
+// Dial connects to the elevator server at addr for the elevator id, and
+// registers the connection in the health registry, see health.Name.
+func Dial(addr string, numFloors int, id string) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
-	_initialized = true
+	name := health.Name(id, HealthName)
+	health.Register(name, _healthTimeout)
+	return &Conn{conn: conn, numFloors: numFloors, healthName: name}, nil
 }
 
-
-
-func SetMotorDirection(dir MotorDirection) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{1, byte(dir), 0, 0})
+// Close closes the connection and removes it from the health registry.
+func (c *Conn) Close() error {
+	health.Unregister(c.healthName)
+	return c.conn.Close()
 }
 
-func SetButtonLamp(button ButtonType, floor int, value bool) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{2, byte(button), byte(floor), toByte(value)})
+func (c *Conn) SetMotorDirection(dir MotorDirection) {
+	c.write([4]byte{1, byte(dir), 0, 0})
 }
 
-func SetFloorIndicator(floor int) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{3, byte(floor), 0, 0})
+func (c *Conn) SetButtonLamp(button ButtonType, floor int, value bool) {
+	c.write([4]byte{2, byte(button), byte(floor), toByte(value)})
 }
 
-func SetDoorOpenLamp(value bool) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{4, toByte(value), 0, 0})
+func (c *Conn) SetFloorIndicator(floor int) {
+	c.write([4]byte{3, byte(floor), 0, 0})
 }
 
-func SetStopLamp(value bool) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{5, toByte(value), 0, 0})
+func (c *Conn) SetDoorOpenLamp(value bool) {
+	c.write([4]byte{4, toByte(value), 0, 0})
 }
 
+func (c *Conn) SetStopLamp(value bool) {
+	c.write([4]byte{5, toByte(value), 0, 0})
+}
 
-
-func PollButtons(receiver chan<- ButtonEvent) {
-	prev := make([][3]bool, _numFloors)
+func (c *Conn) PollButtons(ctx context.Context, receiver chan<- ButtonEvent) {
+	prev := make([][3]bool, c.numFloors)
 	for {
-		time.Sleep(_pollRate)
-		for f := 0; f < _numFloors; f++ {
+		select {
+		case <-time.After(_pollRate):
+		case <-ctx.Done():
+			return
+		}
+		ok := true
+		for f := 0; f < c.numFloors; f++ {
 			for b := ButtonType(0); b < 3; b++ {
-				v := getButton(b, f)
+				v, err := c.getButton(b, f)
+				if err != nil {
+					ok = false
+					continue
+				}
 				if v != prev[f][b] && v != false {
-					receiver <- ButtonEvent{f, ButtonType(b)}
+					select {
+					case receiver <- ButtonEvent{f, ButtonType(b)}:
+					case <-ctx.Done():
+						return
+					}
 				}
 				prev[f][b] = v
 			}
 		}
+		if ok {
+			health.Beat(c.healthName)
+		}
 	}
 }
 
-func PollFloorSensor(receiver chan<- int) {
+func (c *Conn) PollFloorSensor(ctx context.Context, receiver chan<- int) {
 	prev := -1
 	for {
-		time.Sleep(_pollRate)
-		v := getFloor()
+		select {
+		case <-time.After(_pollRate):
+		case <-ctx.Done():
+			return
+		}
+		v, err := c.getFloor()
+		if err != nil {
+			continue
+		}
 		if v != prev && v != -1 {
-			receiver <- v
+			select {
+			case receiver <- v:
+			case <-ctx.Done():
+				return
+			}
 		}
 		prev = v
+		health.Beat(c.healthName)
 	}
 }
 
-func PollStopButton(receiver chan<- bool) {
+func (c *Conn) PollStopButton(ctx context.Context, receiver chan<- bool) {
 	prev := false
 	for {
-		time.Sleep(_pollRate)
-		v := getStop()
+		select {
+		case <-time.After(_pollRate):
+		case <-ctx.Done():
+			return
+		}
+		v, err := c.getStop()
+		if err != nil {
+			continue
+		}
 		if v != prev {
-			receiver <- v
+			select {
+			case receiver <- v:
+			case <-ctx.Done():
+				return
+			}
 		}
 		prev = v
 	}
 }
 
-func PollObstructionSwitch(receiver chan<- bool) {
+func (c *Conn) PollObstructionSwitch(ctx context.Context, receiver chan<- bool) {
 	prev := false
 	for {
-		time.Sleep(_pollRate)
-		v := getObstruction()
+		select {
+		case <-time.After(_pollRate):
+		case <-ctx.Done():
+			return
+		}
+		v, err := c.getObstruction()
+		if err != nil {
+			continue
+		}
 		if v != prev {
-			receiver <- v
+			select {
+			case receiver <- v:
+			case <-ctx.Done():
+				return
+			}
 		}
 		prev = v
 	}
 }
 
+// GetFloor returns the floor the car is at, or -1 if it's between floors or
+// the floor couldn't be read.
+func (c *Conn) GetFloor() int {
+	v, err := c.getFloor()
+	if err != nil {
+		return -1
+	}
+	return v
+}
 
+// write sends a command to the elevator server. Errors are reported to the
+// health registry.
+func (c *Conn) write(cmd [4]byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, err := c.conn.Write(cmd[:]); err != nil {
+		health.Fail(c.healthName, err)
+	}
+}
 
-
-
-
-
-func getButton(button ButtonType, floor int) bool {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{6, byte(button), byte(floor), 0})
+// query sends a command to the elevator server and reads the reply. Errors
+// are reported to the health registry.
+func (c *Conn) query(cmd [4]byte) ([4]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	var buf [4]byte
-	_conn.Read(buf[:])
-	return toBool(buf[1])
+	if _, err := c.conn.Write(cmd[:]); err != nil {
+		health.Fail(c.healthName, err)
+		return buf, err
+	}
+	if _, err := io.ReadFull(c.conn, buf[:]); err != nil {
+		health.Fail(c.healthName, err)
+		return buf, err
+	}
+	return buf, nil
 }
 
-func getFloor() int {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{7, 0, 0, 0})
-	var buf [4]byte
-	_conn.Read(buf[:])
+func (c *Conn) getButton(button ButtonType, floor int) (bool, error) {
+	buf, err := c.query([4]byte{6, byte(button), byte(floor), 0})
+	return toBool(buf[1]), err
+}
+
+func (c *Conn) getFloor() (int, error) {
+	buf, err := c.query([4]byte{7, 0, 0, 0})
+	if err != nil {
+		return -1, err
+	}
 	if buf[1] != 0 {
-		return int(buf[2])
+		return int(buf[2]), nil
 	} else {
-		return -1
+		return -1, nil
 	}
 }
 
-func getStop() bool {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{8, 0, 0, 0})
-	var buf [4]byte
-	_conn.Read(buf[:])
-	return toBool(buf[1])
+func (c *Conn) getStop() (bool, error) {
+	buf, err := c.query([4]byte{8, 0, 0, 0})
+	return toBool(buf[1]), err
 }
 
-func getObstruction() bool {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{9, 0, 0, 0})
-	var buf [4]byte
-	_conn.Read(buf[:])
-	return toBool(buf[1])
+func (c *Conn) getObstruction() (bool, error) {
+	buf, err := c.query([4]byte{9, 0, 0, 0})
+	return toBool(buf[1]), err
 }
 
 func toByte(a bool) byte {
@@ -0,0 +1,244 @@
+package fsm
+
+import (
+	"fmt"
+	"strings"
+
+	"../../elevTypes/elevator"
+)
+
+// Event is something that makes the elevator change state.
+type Event int
+
+const (
+	// Start starts the motor in a direction, or changes the direction.
+	Start Event = 0
+	// Halt stops the motor without opening the door.
+	Halt Event = 1
+	// Arrive stops the motor at the target floor and opens the door.
+	Arrive Event = 2
+	// CloseDoor closes the door.
+	CloseDoor Event = 3
+	// Fail is the motor not reaching a floor in time.
+	Fail Event = 4
+	// Recover is a floor reached after the motor failed.
+	Recover Event = 5
+)
+
+// Events is all events, in the order they're rendered by Dot.
+var Events = []Event{Start, Halt, Arrive, CloseDoor, Fail, Recover}
+
+// States is all states, in the order they're rendered by Dot.
+var States = []elevator.State{
+	elevator.Init, elevator.Idle, elevator.Moving, elevator.DoorOpen, elevator.Error}
+
+// String returns the name of the event.
+func (e Event) String() string {
+	switch e {
+	case Start:
+		return "Start"
+	case Halt:
+		return "Halt"
+	case Arrive:
+		return "Arrive"
+	case CloseDoor:
+		return "CloseDoor"
+	case Fail:
+		return "Fail"
+	case Recover:
+		return "Recover"
+	}
+	return fmt.Sprintf("Invalid (%d)", int(e))
+}
+
+// table is the state each event leads to from each state. Events missing for
+// a state are illegal in it.
+var table = map[elevator.State]map[Event]elevator.State{
+	// finding a floor at startup
+	elevator.Init: {
+		Start: elevator.Init,
+		Halt:  elevator.Idle,
+		Fail:  elevator.Error,
+	},
+	elevator.Idle: {
+		Start:  elevator.Moving,
+		Arrive: elevator.DoorOpen,
+	},
+	elevator.Moving: {
+		Start:  elevator.Moving,
+		Halt:   elevator.Idle,
+		Arrive: elevator.DoorOpen,
+		Fail:   elevator.Error,
+	},
+	elevator.DoorOpen: {
+		CloseDoor: elevator.Idle,
+	},
+	elevator.Error: {
+		Recover: elevator.Moving,
+		Halt:    elevator.Idle,
+	},
+}
+
+// Transition is a change of state, emitted to the observers of a Machine.
+type Transition struct {
+	From      elevator.State
+	To        elevator.State
+	Event     Event
+	Direction elevator.Direction
+	Door      bool
+}
+
+func (t Transition) String() string {
+	return fmt.Sprintf("%s -> %s on %s (dir:'%s' door:%v)",
+		t.From, t.To, t.Event, t.Direction, t.Door)
+}
+
+// TransitionError is returned for an event that isn't allowed in the current
+// state, or would leave the elevator in an illegal combination of state,
+// direction and door.
+type TransitionError struct {
+	From      elevator.State
+	Event     Event
+	Direction elevator.Direction
+	Reason    string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s in state %s with direction %s: %s",
+		e.Event, e.From, e.Direction, e.Reason)
+}
+
+// Machine is the state, motor direction and door of an elevator. They're only
+// changed by events, and every change is checked against the transition table
+// and the invariants in check.
+type Machine struct {
+	state     elevator.State
+	direction elevator.Direction
+	door      bool
+	observers []func(Transition)
+}
+
+// New returns a machine in state with the motor running in direction. The
+// door is open in DoorOpen. An error is returned if the combination is
+// illegal.
+func New(state elevator.State, direction elevator.Direction) (*Machine, error) {
+	door := state == elevator.DoorOpen
+	if reason := check(state, direction, door); reason != "" {
+		return nil, fmt.Errorf("state %s with direction %s: %s", state, direction, reason)
+	}
+	return &Machine{state: state, direction: direction, door: door}, nil
+}
+
+// check returns why a combination of state, direction and door is illegal, or
+// an empty string. In Init and Error the motor can run either way or be
+// stopped.
+func check(state elevator.State, direction elevator.Direction, door bool) string {
+	switch {
+	case direction != elevator.Up && direction != elevator.Down &&
+		direction != elevator.Stop:
+		return "invalid direction"
+	case state == elevator.Moving && direction == elevator.Stop:
+		return "moving with the motor stopped"
+	case (state == elevator.Idle || state == elevator.DoorOpen) &&
+		direction != elevator.Stop:
+		return "motor running while standing still"
+	case door != (state == elevator.DoorOpen):
+		return "door open outside DoorOpen, or closed in it"
+	}
+	return ""
+}
+
+// Observe makes fn be called with every transition, in the goroutine the
+// event is given in.
+func (m *Machine) Observe(fn func(Transition)) {
+	m.observers = append(m.observers, fn)
+}
+
+// State returns the current state.
+func (m *Machine) State() elevator.State {
+	return m.state
+}
+
+// Direction returns the direction the motor is running.
+func (m *Machine) Direction() elevator.Direction {
+	return m.direction
+}
+
+// Door reports whether the door is open.
+func (m *Machine) Door() bool {
+	return m.door
+}
+
+// Start starts the motor in direction, or changes its direction.
+func (m *Machine) Start(direction elevator.Direction) error {
+	return m.fire(Start, direction)
+}
+
+// Halt stops the motor without opening the door.
+func (m *Machine) Halt() error {
+	return m.fire(Halt, elevator.Stop)
+}
+
+// Arrive stops the motor and opens the door.
+func (m *Machine) Arrive() error {
+	return m.fire(Arrive, elevator.Stop)
+}
+
+// CloseDoor closes the door.
+func (m *Machine) CloseDoor() error {
+	return m.fire(CloseDoor, elevator.Stop)
+}
+
+// Fail marks the motor as failed. It's still running.
+func (m *Machine) Fail() error {
+	return m.fire(Fail, m.direction)
+}
+
+// GiveUp marks the motor as failed and stopped, for when it isn't expected to
+// recover.
+func (m *Machine) GiveUp() error {
+	return m.fire(Fail, elevator.Stop)
+}
+
+// Recover marks the motor as working again.
+func (m *Machine) Recover() error {
+	return m.fire(Recover, m.direction)
+}
+
+// fire makes the transition for ev, with the motor running in direction
+// afterwards. The machine is unchanged if an error is returned.
+func (m *Machine) fire(ev Event, direction elevator.Direction) error {
+	to, ok := table[m.state][ev]
+	if !ok {
+		return &TransitionError{m.state, ev, m.direction, "not allowed in this state"}
+	}
+	door := to == elevator.DoorOpen
+	if reason := check(to, direction, door); reason != "" {
+		return &TransitionError{m.state, ev, m.direction, reason}
+	}
+
+	t := Transition{From: m.state, To: to, Event: ev, Direction: direction, Door: door}
+	m.state, m.direction, m.door = to, direction, door
+	for _, fn := range m.observers {
+		fn(t)
+	}
+	return nil
+}
+
+// Dot renders the transition table as a Graphviz digraph.
+func Dot() string {
+	var b strings.Builder
+	b.WriteString("digraph elevator {\n")
+	for _, s := range States {
+		fmt.Fprintf(&b, "\t%s;\n", s)
+	}
+	for _, s := range States {
+		for _, ev := range Events {
+			if to, ok := table[s][ev]; ok {
+				fmt.Fprintf(&b, "\t%s -> %s [label=\"%s\"];\n", s, to, ev)
+			}
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
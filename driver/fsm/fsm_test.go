@@ -0,0 +1,166 @@
+package fsm
+
+import (
+	"errors"
+	"testing"
+
+	"../../elevTypes/elevator"
+)
+
+// startDirection is a legal direction of the motor in each state, used to
+// create the machine the events are fired in.
+var startDirection = map[elevator.State]elevator.Direction{
+	elevator.Init:     elevator.Down,
+	elevator.Idle:     elevator.Stop,
+	elevator.Moving:   elevator.Up,
+	elevator.DoorOpen: elevator.Stop,
+	elevator.Error:    elevator.Up,
+}
+
+// fire gives ev to m through its method. Start starts the motor upwards.
+func fire(m *Machine, ev Event) error {
+	switch ev {
+	case Start:
+		return m.Start(elevator.Up)
+	case Halt:
+		return m.Halt()
+	case Arrive:
+		return m.Arrive()
+	case CloseDoor:
+		return m.CloseDoor()
+	case Fail:
+		return m.Fail()
+	case Recover:
+		return m.Recover()
+	}
+	panic("unknown event " + ev.String())
+}
+
+func TestTransitions(t *testing.T) {
+	// the state each event leads to from each state, missing events are
+	// illegal
+	want := map[elevator.State]map[Event]elevator.State{
+		elevator.Init: {
+			Start: elevator.Init,
+			Halt:  elevator.Idle,
+			Fail:  elevator.Error,
+		},
+		elevator.Idle: {
+			Start:  elevator.Moving,
+			Arrive: elevator.DoorOpen,
+		},
+		elevator.Moving: {
+			Start:  elevator.Moving,
+			Halt:   elevator.Idle,
+			Arrive: elevator.DoorOpen,
+			Fail:   elevator.Error,
+		},
+		elevator.DoorOpen: {
+			CloseDoor: elevator.Idle,
+		},
+		elevator.Error: {
+			Recover: elevator.Moving,
+			Halt:    elevator.Idle,
+		},
+	}
+
+	for _, from := range States {
+		for _, ev := range Events {
+			m, err := New(from, startDirection[from])
+			if err != nil {
+				t.Fatalf("New(%s): %v", from, err)
+			}
+			var observed []Transition
+			m.Observe(func(tr Transition) { observed = append(observed, tr) })
+
+			err = fire(m, ev)
+			to, legal := want[from][ev]
+			if !legal {
+				var terr *TransitionError
+				if !errors.As(err, &terr) {
+					t.Errorf("%s in %s: got error %v, want a TransitionError", ev, from, err)
+				}
+				if m.State() != from || m.Direction() != startDirection[from] ||
+					len(observed) != 0 {
+					t.Errorf("%s in %s: machine changed to %s (dir:'%s') on an illegal event",
+						ev, from, m.State(), m.Direction())
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%s in %s: %v, want %s", ev, from, err, to)
+				continue
+			}
+			if m.State() != to {
+				t.Errorf("%s in %s: state %s, want %s", ev, from, m.State(), to)
+			}
+			if m.Door() != (to == elevator.DoorOpen) {
+				t.Errorf("%s in %s: door %v in state %s", ev, from, m.Door(), to)
+			}
+			if len(observed) != 1 || observed[0].From != from || observed[0].To != to ||
+				observed[0].Event != ev {
+				t.Errorf("%s in %s: observed %v, want one transition to %s",
+					ev, from, observed, to)
+			}
+		}
+	}
+}
+
+func TestIllegalCombinations(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     elevator.State
+		direction elevator.Direction
+		fire      func(m *Machine) error
+	}{
+		{"start without a direction", elevator.Idle, elevator.Stop,
+			func(m *Machine) error { return m.Start(elevator.Stop) }},
+		{"recover with the motor stopped", elevator.Error, elevator.Stop,
+			(*Machine).Recover},
+		{"start with an invalid direction", elevator.Moving, elevator.Up,
+			func(m *Machine) error { return m.Start(elevator.Direction(7)) }},
+	}
+	for _, tt := range tests {
+		m, err := New(tt.state, tt.direction)
+		if err != nil {
+			t.Fatalf("%s: New: %v", tt.name, err)
+		}
+		var terr *TransitionError
+		if err := tt.fire(m); !errors.As(err, &terr) {
+			t.Errorf("%s: got error %v, want a TransitionError", tt.name, err)
+		}
+		if m.State() != tt.state || m.Direction() != tt.direction {
+			t.Errorf("%s: machine changed to %s (dir:'%s')", tt.name, m.State(), m.Direction())
+		}
+	}
+
+	for _, tt := range []struct {
+		state     elevator.State
+		direction elevator.Direction
+	}{
+		{elevator.Moving, elevator.Stop},
+		{elevator.Idle, elevator.Up},
+		{elevator.DoorOpen, elevator.Down},
+	} {
+		if _, err := New(tt.state, tt.direction); err == nil {
+			t.Errorf("New(%s, %s) succeeded, want an error", tt.state, tt.direction)
+		}
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	for _, from := range []elevator.State{elevator.Init, elevator.Moving} {
+		m, err := New(from, elevator.Down)
+		if err != nil {
+			t.Fatalf("New(%s): %v", from, err)
+		}
+		if err := m.GiveUp(); err != nil {
+			t.Errorf("GiveUp in %s: %v", from, err)
+		}
+		if m.State() != elevator.Error || m.Direction() != elevator.Stop {
+			t.Errorf("GiveUp in %s: state %s (dir:'%s'), want Error with the motor stopped",
+				from, m.State(), m.Direction())
+		}
+	}
+}
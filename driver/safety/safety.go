@@ -0,0 +1,295 @@
+package safety
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"../../elevTypes/order"
+	"../../health"
+	"../elevio"
+)
+
+// HealthName is the name the monitor reports violations under, see the health
+// package and NewMonitor. It's unhealthy after the first violation, so the process is
+// restarted by the watchdog program.
+const HealthName = "safety"
+
+// IO is the elevator hardware watched by the monitor, the same as driver.IO.
+type IO interface {
+	SetMotorDirection(dir elevio.MotorDirection)
+	SetButtonLamp(button elevio.ButtonType, floor int, value bool)
+	SetFloorIndicator(floor int)
+	SetDoorOpenLamp(value bool)
+	SetStopLamp(value bool)
+	GetFloor() int
+	PollButtons(ctx context.Context, receiver chan<- elevio.ButtonEvent)
+	PollFloorSensor(ctx context.Context, receiver chan<- int)
+}
+
+// Invariant is a property of the hardware that must always hold.
+type Invariant int
+
+const (
+	// MotorWithDoorOpen is the motor running while the door lamp is on.
+	MotorWithDoorOpen Invariant = 0
+	// DoorBetweenFloors is the door opening while the car isn't at a floor.
+	DoorBetweenFloors Invariant = 1
+	// IndicatorMismatch is the floor indicator set to another floor than the
+	// sensor last read.
+	IndicatorMismatch Invariant = 2
+	// FinishedWithoutStop is an order finished while the car isn't stopped at
+	// its floor.
+	FinishedWithoutStop Invariant = 3
+	// FloorOutOfRange is the floor sensor reading a floor that doesn't exist.
+	FloorOutOfRange Invariant = 4
+)
+
+// How many sensor readings handed to the driver are remembered, see
+// Monitor.sensed.
+const maxSensed int = 16
+
+func (inv Invariant) String() string {
+	switch inv {
+	case MotorWithDoorOpen:
+		return "motor running with door open"
+	case DoorBetweenFloors:
+		return "door opened between floors"
+	case IndicatorMismatch:
+		return "floor indicator doesn't match sensor"
+	case FinishedWithoutStop:
+		return "order finished without stopping at its floor"
+	case FloorOutOfRange:
+		return "floor sensor out of range"
+	}
+	return fmt.Sprintf("invalid invariant (%d)", int(inv))
+}
+
+// Violation is a broken invariant, with the state of the hardware when it was
+// detected.
+type Violation struct {
+	Invariant Invariant
+	Context   string
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("%s: %s", v.Invariant, v.Context)
+}
+
+// Monitor sits between the driver and the hardware and checks every command
+// against the invariants, independently of the driver logic. On a violation
+// the motor is stopped and isn't started again, the violation is logged and
+// counted, and it's sent on Tripped so the driver can give up its active
+// order.
+type Monitor struct {
+	hw         IO
+	nfloors    int
+	healthName string
+	tripped    chan Violation
+
+	mtx       sync.Mutex
+	motor     elevio.MotorDirection
+	door      bool
+	indicator int
+	// sensed is the floors read by the sensor and handed to the driver,
+	// oldest first, starting with the one on the indicator. The driver may
+	// be behind the sensor when the car passes floors quickly, so the
+	// indicator can be set to any of them.
+	sensed  []int
+	stopped bool
+	counts  map[Invariant]int
+}
+
+// NewMonitor returns a monitor for hw with nfloors floors and registers it in
+// the health registry under HealthName for the elevator id, see health.Name.
+func NewMonitor(hw IO, id string, nfloors int) *Monitor {
+	name := health.Name(id, HealthName)
+	health.Register(name, 0)
+	return &Monitor{
+		hw:         hw,
+		nfloors:    nfloors,
+		healthName: name,
+		tripped:    make(chan Violation, 1),
+		motor:      elevio.MD_Stop,
+		indicator:  -1,
+		counts:     make(map[Invariant]int),
+	}
+}
+
+// Close removes the monitor from the health registry.
+func (m *Monitor) Close() {
+	health.Unregister(m.healthName)
+}
+
+// Tripped returns a channel which is filled when an invariant is violated. If
+// the previous violation hasn't been received, only that one is kept.
+func (m *Monitor) Tripped() <-chan Violation {
+	return m.tripped
+}
+
+// Counts returns how many times each invariant has been violated.
+func (m *Monitor) Counts() map[Invariant]int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	counts := make(map[Invariant]int, len(m.counts))
+	for inv, n := range m.counts {
+		counts[inv] = n
+	}
+	return counts
+}
+
+// violate stops the car and reports a violation. m.mtx must be held.
+func (m *Monitor) violate(inv Invariant, format string, args ...interface{}) {
+	m.counts[inv]++
+	v := Violation{inv, fmt.Sprintf(format, args...) + ". " + m.context()}
+	log.Printf("Safety violation #%d: %v\n", m.counts[inv], v)
+
+	m.hw.SetMotorDirection(elevio.MD_Stop)
+	m.motor = elevio.MD_Stop
+	if !m.stopped {
+		log.Println("Safety stop, the motor won't be started again.")
+		m.stopped = true
+	}
+	health.Fail(m.healthName, v)
+	select {
+	case m.tripped <- v:
+	default:
+	}
+}
+
+// context describes the hardware for the log. m.mtx must be held.
+func (m *Monitor) context() string {
+	return fmt.Sprintf("motor:%d door:%v indicator:%d sensed:%v sensor now:%d",
+		m.motor, m.door, m.indicator, m.sensed, m.hw.GetFloor())
+}
+
+// sense records a floor read by the sensor before it's handed to the driver,
+// and reports whether it's a floor that exists. m.mtx must be held.
+func (m *Monitor) sense(floor int) bool {
+	if floor < 0 || floor >= m.nfloors {
+		m.violate(FloorOutOfRange, "sensor read floor %d of %d", floor, m.nfloors)
+		return false
+	}
+	m.sensed = append(m.sensed, floor)
+	if len(m.sensed) > maxSensed {
+		m.sensed = m.sensed[len(m.sensed)-maxSensed:]
+	}
+	return true
+}
+
+// Finished checks that the car is stopped at the floor of o, which the driver
+// has just finished.
+func (m *Monitor) Finished(o order.Order) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if floor := m.hw.GetFloor(); floor != o.Floor || m.motor != elevio.MD_Stop {
+		m.violate(FinishedWithoutStop, "finished %s", o.ToString())
+	}
+}
+
+func (m *Monitor) SetMotorDirection(dir elevio.MotorDirection) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if dir != elevio.MD_Stop {
+		if m.door {
+			m.violate(MotorWithDoorOpen, "motor started in direction %d", dir)
+			return
+		}
+		if m.stopped {
+			log.Printf("Safety stop, not starting motor in direction %d.\n", dir)
+			return
+		}
+	}
+	m.hw.SetMotorDirection(dir)
+	m.motor = dir
+}
+
+func (m *Monitor) SetButtonLamp(button elevio.ButtonType, floor int, value bool) {
+	m.hw.SetButtonLamp(button, floor, value)
+}
+
+func (m *Monitor) SetFloorIndicator(floor int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.hw.SetFloorIndicator(floor)
+	m.indicator = floor
+	for i, f := range m.sensed {
+		if f == floor {
+			// the older readings have been passed
+			m.sensed = m.sensed[i:]
+			return
+		}
+	}
+	m.violate(IndicatorMismatch, "indicator set to %d", floor)
+}
+
+func (m *Monitor) SetDoorOpenLamp(value bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if value {
+		if m.motor != elevio.MD_Stop {
+			m.violate(MotorWithDoorOpen, "door opened")
+		}
+		if m.hw.GetFloor() == -1 {
+			m.violate(DoorBetweenFloors, "door opened")
+			return
+		}
+	}
+	m.hw.SetDoorOpenLamp(value)
+	m.door = value
+}
+
+func (m *Monitor) SetStopLamp(value bool) {
+	m.hw.SetStopLamp(value)
+}
+
+// GetFloor returns -1, like between floors, if the sensor reads a floor that
+// doesn't exist.
+func (m *Monitor) GetFloor() int {
+	floor := m.hw.GetFloor()
+	if floor == -1 {
+		return floor
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.sense(floor) {
+		return -1
+	}
+	return floor
+}
+
+func (m *Monitor) PollButtons(ctx context.Context, receiver chan<- elevio.ButtonEvent) {
+	m.hw.PollButtons(ctx, receiver)
+}
+
+// PollFloorSensor records each floor before it's passed on to receiver. Floors
+// that don't exist aren't passed on.
+func (m *Monitor) PollFloorSensor(ctx context.Context, receiver chan<- int) {
+	floors := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.hw.PollFloorSensor(ctx, floors)
+	}()
+	defer func() { <-done }()
+
+	for {
+		select {
+		case floor := <-floors:
+			m.mtx.Lock()
+			ok := m.sense(floor)
+			m.mtx.Unlock()
+			if !ok {
+				continue
+			}
+			select {
+			case receiver <- floor:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
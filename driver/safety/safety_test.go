@@ -0,0 +1,191 @@
+package safety
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"../../elevTypes/order"
+	"../elevio"
+)
+
+// fakeIO is elevator hardware where the car is at floor, or between floors
+// if it's -1. PollFloorSensor passes on the readings sent on readings.
+type fakeIO struct {
+	floor    int
+	motor    elevio.MotorDirection
+	door     bool
+	readings chan int
+}
+
+func (f *fakeIO) SetMotorDirection(dir elevio.MotorDirection)                   { f.motor = dir }
+func (f *fakeIO) SetButtonLamp(button elevio.ButtonType, floor int, value bool) {}
+func (f *fakeIO) SetFloorIndicator(floor int)                                   {}
+func (f *fakeIO) SetDoorOpenLamp(value bool)                                    { f.door = value }
+func (f *fakeIO) SetStopLamp(value bool)                                        {}
+func (f *fakeIO) GetFloor() int                                                 { return f.floor }
+func (f *fakeIO) PollButtons(ctx context.Context, receiver chan<- elevio.ButtonEvent) {
+	<-ctx.Done()
+}
+func (f *fakeIO) PollFloorSensor(ctx context.Context, receiver chan<- int) {
+	for {
+		select {
+		case floor := <-f.readings:
+			receiver <- floor
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newTestMonitor returns a monitor of a car at floor of a building with 4
+// floors, with the floor sensor read once like at startup.
+func newTestMonitor(t *testing.T, floor int) (*Monitor, *fakeIO) {
+	hw := &fakeIO{floor: floor, readings: make(chan int)}
+	m := NewMonitor(hw, "test", 4)
+	t.Cleanup(m.Close)
+	if floor != -1 {
+		m.GetFloor()
+		m.SetFloorIndicator(floor)
+	}
+	return m, hw
+}
+
+// expectViolation fails the test unless inv is the only invariant violated,
+// and the motor has been stopped.
+func expectViolation(t *testing.T, m *Monitor, hw *fakeIO, inv Invariant) {
+	t.Helper()
+	select {
+	case v := <-m.Tripped():
+		if v.Invariant != inv {
+			t.Errorf("tripped on '%s', want '%s'", v, inv)
+		}
+	default:
+		t.Errorf("didn't trip, want '%s'", inv)
+	}
+	if counts := m.Counts(); len(counts) != 1 || counts[inv] != 1 {
+		t.Errorf("violations %v, want one of '%s'", counts, inv)
+	}
+	if hw.motor != elevio.MD_Stop {
+		t.Errorf("motor is %d after a violation, want stopped", hw.motor)
+	}
+}
+
+// expectNoViolation fails the test if an invariant was violated.
+func expectNoViolation(t *testing.T, m *Monitor) {
+	t.Helper()
+	if counts := m.Counts(); len(counts) != 0 {
+		t.Errorf("violations %v, want none", counts)
+	}
+}
+
+func TestMotorWithDoorOpen(t *testing.T) {
+	m, hw := newTestMonitor(t, 1)
+	m.SetDoorOpenLamp(true)
+	m.SetMotorDirection(elevio.MD_Up)
+	expectViolation(t, m, hw, MotorWithDoorOpen)
+
+	// the motor is never started again
+	m.SetDoorOpenLamp(false)
+	m.SetMotorDirection(elevio.MD_Up)
+	if hw.motor != elevio.MD_Stop {
+		t.Errorf("motor started after a safety stop")
+	}
+}
+
+func TestDoorOpenedWithMotorRunning(t *testing.T) {
+	m, hw := newTestMonitor(t, 1)
+	m.SetMotorDirection(elevio.MD_Down)
+	m.SetDoorOpenLamp(true)
+	expectViolation(t, m, hw, MotorWithDoorOpen)
+}
+
+func TestDoorBetweenFloors(t *testing.T) {
+	m, hw := newTestMonitor(t, 1)
+	hw.floor = -1
+	m.SetDoorOpenLamp(true)
+	expectViolation(t, m, hw, DoorBetweenFloors)
+	if hw.door {
+		t.Error("door opened between floors")
+	}
+}
+
+func TestIndicatorMismatch(t *testing.T) {
+	m, hw := newTestMonitor(t, 1)
+	m.SetFloorIndicator(2)
+	expectViolation(t, m, hw, IndicatorMismatch)
+}
+
+func TestFinishedWithoutStop(t *testing.T) {
+	m, hw := newTestMonitor(t, 1)
+	m.SetMotorDirection(elevio.MD_Up)
+	m.Finished(order.Order{Floor: 1, Type: order.Cab, Status: order.Finished})
+	expectViolation(t, m, hw, FinishedWithoutStop)
+}
+
+func TestFloorOutOfRange(t *testing.T) {
+	m, hw := newTestMonitor(t, -1)
+	hw.floor = 4
+	if floor := m.GetFloor(); floor != -1 {
+		t.Errorf("GetFloor returned %d, want -1 for a floor that doesn't exist", floor)
+	}
+	expectViolation(t, m, hw, FloorOutOfRange)
+}
+
+// TestPollFloorSensor checks that the indicator can follow the floors handed
+// to the driver while the sensor is ahead of it, and that floors that don't
+// exist aren't handed over.
+func TestPollFloorSensor(t *testing.T) {
+	m, hw := newTestMonitor(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	floors := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.PollFloorSensor(ctx, floors)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	receive := func(want int) {
+		t.Helper()
+		select {
+		case floor := <-floors:
+			if floor != want {
+				t.Fatalf("received floor %d, want %d", floor, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("floor %d wasn't passed on", want)
+		}
+	}
+
+	// the car passes 1 and reaches 2 before the driver has handled 1
+	hw.readings <- 1
+	receive(1)
+	hw.readings <- 2
+	for deadline := time.Now().Add(time.Second); ; {
+		m.mtx.Lock()
+		n := len(m.sensed)
+		m.mtx.Unlock()
+		if n == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.SetFloorIndicator(1)
+	receive(2)
+	m.SetFloorIndicator(2)
+	expectNoViolation(t, m)
+
+	// 1 has been passed, the indicator can't go back to it
+	hw.readings <- 7
+	hw.readings <- 3
+	receive(3)
+	expectViolation(t, m, hw, FloorOutOfRange)
+	m.SetFloorIndicator(3)
+	m.SetFloorIndicator(1)
+	if counts := m.Counts(); counts[IndicatorMismatch] != 1 {
+		t.Errorf("violations %v, want the indicator going back to a passed floor", counts)
+	}
+}
@@ -27,6 +27,36 @@ const (
 	Error    State = 4
 )
 
+// String returns the name of the direction.
+func (d Direction) String() string {
+	switch d {
+	case Up:
+		return "Up"
+	case Down:
+		return "Down"
+	case Stop:
+		return "Stop"
+	}
+	return fmt.Sprintf("Invalid (%d)", int(d))
+}
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case Init:
+		return "Init"
+	case Idle:
+		return "Idle"
+	case Moving:
+		return "Moving"
+	case DoorOpen:
+		return "DoorOpen"
+	case Error:
+		return "Error"
+	}
+	return fmt.Sprintf("Invalid (%d)", int(s))
+}
+
 // Elevator is a struct of variables key to controlling the elevator.
 type Elevator struct {
 	ActiveOrder order.Order
@@ -40,14 +70,14 @@ type Elevator struct {
 }
 
 // CheckOrderTimestamp checks the Orders matrix for orders where the current
-// time is passed the stored timeout time, and pushes all timed out orders onto
-// timeoutChan channel.
-func (elev *Elevator) CheckOrderTimestamp(timeoutChan chan<- order.Order) {
+// time now is passed the stored timeout time, and pushes all timed out orders
+// onto timeoutChan channel.
+func (elev *Elevator) CheckOrderTimestamp(now time.Time, timeoutChan chan<- order.Order) {
 	//Loop through all orders in matrix
 	for f := 0; f < len(elev.Orders); f++ {
 		for t := range elev.Orders[f] {
 
-			currentTime := time.Now().Unix() //get current time
+			currentTime := now.Unix()
 
 			//check if order is taken
 			if elev.Orders[f][t].Status == order.Taken {
@@ -61,7 +91,8 @@ func (elev *Elevator) CheckOrderTimestamp(timeoutChan chan<- order.Order) {
 	}
 }
 
-// NewElevator creates a new elevator object and initializes its order matrix.
+// NewElevator creates a new elevator object and initializes its order matrix,
+// where every cell has the floor and type of its position.
 // This is the prefered way of creating a new elevator object.
 func NewElevator(nfloors, nbuttons int) Elevator {
 	var elev Elevator
@@ -71,41 +102,52 @@ func NewElevator(nfloors, nbuttons int) Elevator {
 	elev.Orders = make([][]order.Order, nfloors)
 	for i := range elev.Orders {
 		elev.Orders[i] = make([]order.Order, nbuttons)
+		for t := range elev.Orders[i] {
+			elev.Orders[i][t].Floor, elev.Orders[i][t].Type = i, order.Type(t)
+		}
 	}
 
-	elev.State = Idle
+	elev.State = Init
 	elev.ActiveOrder.Status = order.Finished
 	return elev
 }
 
-// ToString creates a string representation of an elevator object.
-func (elev *Elevator) ToString() string {
-	dirStr := fmt.Sprintf("Invalid (%d)", elev.Direction)
-	switch elev.Direction {
-	case Up:
-		dirStr = "Up"
-	case Down:
-		dirStr = "Down"
-	case Stop:
-		dirStr = "Stop"
+// Copy returns a copy of the elevator with its own order matrix. A plain
+// assignment shares the matrix with the original.
+func (elev *Elevator) Copy() Elevator {
+	c := *elev
+	c.Orders = make([][]order.Order, len(elev.Orders))
+	for i := range elev.Orders {
+		c.Orders[i] = make([]order.Order, len(elev.Orders[i]))
+		copy(c.Orders[i], elev.Orders[i])
 	}
+	return c
+}
 
-	stateStr := ""
-	switch elev.State {
-	case Init:
-		stateStr = "Init"
-	case Idle:
-		stateStr = "Idle"
-	case Moving:
-		stateStr = "Moving"
-	case DoorOpen:
-		stateStr = "DoorOpen"
-	case Error:
-		stateStr = "Error"
+// Equal reports whether other has the same state and orders as elev.
+func (elev *Elevator) Equal(other Elevator) bool {
+	if elev.ActiveOrder != other.ActiveOrder || elev.Floor != other.Floor ||
+		elev.Direction != other.Direction || elev.State != other.State ||
+		len(elev.Orders) != len(other.Orders) {
+		return false
 	}
+	for i := range elev.Orders {
+		if len(elev.Orders[i]) != len(other.Orders[i]) {
+			return false
+		}
+		for j := range elev.Orders[i] {
+			if elev.Orders[i][j] != other.Orders[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
 
+// ToString creates a string representation of an elevator object.
+func (elev *Elevator) ToString() string {
 	return fmt.Sprintf("Elevator:{%s floor:%d dir:'%s' state:'%s'}",
-		elev.ActiveOrder.ToString(), elev.Floor, dirStr, stateStr)
+		elev.ActiveOrder.ToString(), elev.Floor, elev.Direction, elev.State)
 }
 
 // OrderMatrixToString creates a string representation of the order matrix. The
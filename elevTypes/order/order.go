@@ -6,7 +6,7 @@ import (
 
 const (
 	// OrderTimeout is how long an order can be Taken before a Finished message
-	// must be received.
+	// must be received, unless configured otherwise, see driver.Timing.
 	OrderTimeout int64 = 10 // seconds
 )
 
@@ -49,7 +49,10 @@ type Order struct {
 	// Status is status of order, see status defines..
 	Status Status
 	// LocalTimeStamp is used to check if an order that is marked as taken is
-	// not forgotten about.
+	// not forgotten about, it's the Unix time the order must be finished by.
+	// A NotTaken order from a button press and a Finished order are stamped
+	// with when they were pressed and finished, so the newest can be kept
+	// when elevators compare their orders.
 	LocalTimeStamp int64
 }
 
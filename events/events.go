@@ -0,0 +1,254 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+)
+
+// Kind is the kind of an event.
+type Kind int
+
+const (
+	// ButtonPressed is a button pressed on the panel, with its floor and the
+	// new order.
+	ButtonPressed Kind = 0
+	// FloorReached is the car reaching a floor.
+	FloorReached Kind = 1
+	// DoorOpened is the door opening at a floor.
+	DoorOpened Kind = 2
+	// DoorClosed is the door closing at a floor.
+	DoorClosed Kind = 3
+	// OrderAssigned is an order being taken by the elevator.
+	OrderAssigned Kind = 4
+	// OrderFinished is an order finished by the elevator.
+	OrderFinished Kind = 5
+	// FaultRaised is something going wrong, described by Fault.
+	FaultRaised Kind = 6
+
+	// The kinds below are published by control, in the control loop.
+
+	// OrderRequested is a button press taken in by control, with the new
+	// order. It's published before the order is sent to the other elevators.
+	OrderRequested Kind = 7
+	// ElevatorChanged is control taking a new state of the elevator into
+	// use, with the state before it in Previous.
+	ElevatorChanged Kind = 8
+	// OrderClaimed is the elevator claiming an order after waiting for the
+	// other elevators to claim it first.
+	OrderClaimed Kind = 9
+	// PeerLost is a peer that hasn't been heard from in a while.
+	PeerLost Kind = 10
+	// PeerSeen is a peer that is new, or back after being lost.
+	PeerSeen Kind = 11
+	// Reconciled is the hall orders merged with the state of a peer, with
+	// Count of them changed.
+	Reconciled Kind = 12
+)
+
+func (k Kind) String() string {
+	switch k {
+	case ButtonPressed:
+		return "ButtonPressed"
+	case FloorReached:
+		return "FloorReached"
+	case DoorOpened:
+		return "DoorOpened"
+	case DoorClosed:
+		return "DoorClosed"
+	case OrderAssigned:
+		return "OrderAssigned"
+	case OrderFinished:
+		return "OrderFinished"
+	case FaultRaised:
+		return "FaultRaised"
+	case OrderRequested:
+		return "OrderRequested"
+	case ElevatorChanged:
+		return "ElevatorChanged"
+	case OrderClaimed:
+		return "OrderClaimed"
+	case PeerLost:
+		return "PeerLost"
+	case PeerSeen:
+		return "PeerSeen"
+	case Reconciled:
+		return "Reconciled"
+	}
+	return fmt.Sprintf("Invalid (%d)", int(k))
+}
+
+// Event is something that happened to an elevator. Only the fields for its
+// kind are set.
+type Event struct {
+	Kind Kind
+	Time time.Time
+	// Floor is set for ButtonPressed, FloorReached, DoorOpened and
+	// DoorClosed.
+	Floor int
+	// Order is set for ButtonPressed, OrderAssigned, OrderFinished,
+	// OrderRequested and OrderClaimed.
+	Order order.Order
+	// Fault is set for FaultRaised.
+	Fault string
+	// Peer is the ID of the peer for PeerLost, PeerSeen and Reconciled.
+	Peer string
+	// Count is set for Reconciled.
+	Count int
+	// Elevator and Previous are set for ElevatorChanged. They must not be
+	// changed by the receivers.
+	Elevator elevator.Elevator
+	Previous elevator.Elevator
+}
+
+// ToString creates a string representation of the event.
+func (ev *Event) ToString() string {
+	switch ev.Kind {
+	case ButtonPressed, OrderAssigned, OrderFinished, OrderRequested, OrderClaimed:
+		return fmt.Sprintf("%s:{%s}", ev.Kind, ev.Order.ToString())
+	case FaultRaised:
+		return fmt.Sprintf("%s:{%s}", ev.Kind, ev.Fault)
+	case ElevatorChanged:
+		return fmt.Sprintf("%s:{%s}", ev.Kind, ev.Elevator.ToString())
+	case PeerLost, PeerSeen:
+		return fmt.Sprintf("%s:{peer:%s}", ev.Kind, ev.Peer)
+	case Reconciled:
+		return fmt.Sprintf("%s:{peer:%s changed:%d}", ev.Kind, ev.Peer, ev.Count)
+	}
+	return fmt.Sprintf("%s:{floor:%d}", ev.Kind, ev.Floor)
+}
+
+// Bus delivers the events published by the driver and control of one
+// elevator to the subscribers and observers of their kind, so they can be
+// observed without changing the driver or control loop. Publish never blocks
+// on a subscriber. A subscriber that falls behind loses events, which are
+// counted. Observers get every event, see Observe.
+type Bus struct {
+	mtx       sync.Mutex
+	subs      map[*Subscription]bool
+	observers []observer
+}
+
+// observer is a function given to Observe.
+type observer struct {
+	fn    func(Event)
+	kinds map[Kind]bool
+}
+
+// kindSet returns kinds as a set. An empty set means all kinds.
+func kindSet(kinds []Kind) map[Kind]bool {
+	set := make(map[Kind]bool)
+	for _, k := range kinds {
+		set[k] = true
+	}
+	return set
+}
+
+// wants reports whether k is in the set of kinds.
+func wants(kinds map[Kind]bool, k Kind) bool {
+	return len(kinds) == 0 || kinds[k]
+}
+
+// Subscription receives events from a bus on C until it's closed.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	kinds   map[Kind]bool
+	dropped int
+	bus     *Bus
+}
+
+// NewBus returns a bus without subscribers.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]bool)}
+}
+
+// Subscribe returns a subscription to events of kinds, or all events if none
+// are given. Up to buffer events wait for the subscriber before new ones are
+// dropped.
+func (b *Bus) Subscribe(buffer int, kinds ...Kind) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, kinds: kindSet(kinds), bus: b}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.subs[s] = true
+	return s
+}
+
+// Observe makes fn be called with every event of kinds, or all events if
+// none are given, in the goroutine that publishes it and before Publish
+// returns. Nothing is dropped, but the publisher waits for fn, so it's meant
+// for what must see every event in order, like the journal.
+func (b *Bus) Observe(fn func(Event), kinds ...Kind) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.observers = append(b.observers, observer{fn: fn, kinds: kindSet(kinds)})
+}
+
+// Publish calls the observers of the kind of ev, and then sends it to every
+// subscriber of its kind that has room for it.
+func (b *Bus) Publish(ev Event) {
+	b.mtx.Lock()
+	observers := b.observers
+	b.mtx.Unlock()
+	// called without the lock, so an observer can publish too
+	for _, o := range observers {
+		if wants(o.kinds, ev.Kind) {
+			o.fn(ev)
+		}
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for s := range b.subs {
+		if !wants(s.kinds, ev.Kind) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// Close removes the subscription from the bus and closes C.
+func (s *Subscription) Close() {
+	s.bus.mtx.Lock()
+	defer s.bus.mtx.Unlock()
+	if s.bus.subs[s] {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// Dropped returns how many events the subscriber has lost because it fell
+// behind.
+func (s *Subscription) Dropped() int {
+	s.bus.mtx.Lock()
+	defer s.bus.mtx.Unlock()
+	return s.dropped
+}
+
+// Log writes the events of sub to the log until ctx is cancelled, and then
+// closes sub.
+func Log(ctx context.Context, sub *Subscription) error {
+	defer sub.Close()
+	for {
+		select {
+		case ev := <-sub.C:
+			log.Printf("Event: %s\n", ev.ToString())
+		case <-ctx.Done():
+			if n := sub.Dropped(); n > 0 {
+				log.Printf("Event log dropped %d events\n", n)
+			}
+			return nil
+		}
+	}
+}
@@ -1,52 +1,286 @@
 package filebackup
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"../elevTypes/elevator"
 )
 
-func Read(fileName string, Nfloors, Nbuttons int) elevator.Elevator {
-	file, err := os.Open(fileName)
+const (
+	// How many generations of the backup to keep.
+	generationsToKeep int = 10
+	// fileNameFormat is formatted with the elevator IO port.
+	fileNameFormat string = "logs/elevBackupFile_%d.log"
+)
+
+// backup is the format of a backup file. Checksum is the hex encoded SHA-256
+// of Elevator, so that a truncated or otherwise corrupt file is detected.
+// Version is the schema version of Elevator, see schemaVersion.
+type backup struct {
+	Version    int
+	Generation uint64
+	Timestamp  int64 // unix nanoseconds
+	Checksum   string
+	Elevator   json.RawMessage
+}
+
+// Generation describes one backup file.
+type Generation struct {
+	Number    uint64
+	FileName  string
+	Timestamp time.Time
+	Checksum  string
+	// Err is why the generation can't be used, or nil if it's valid.
+	Err error
+}
+
+// ErrNoBackup is returned by Read when there is no valid backup.
+var ErrNoBackup = errors.New("no valid backup found")
+
+// FileName returns the backup file name for the elevator on the given IO port.
+// Generations are stored as FileName(port) followed by a generation number.
+func FileName(port int) string {
+	return fmt.Sprintf(fileNameFormat, port)
+}
+
+func generationFileName(fileName string, number uint64) string {
+	return fmt.Sprintf("%s.%06d", fileName, number)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Encode converts elev to the versioned and checksummed backup format.
+func Encode(elev elevator.Elevator) ([]byte, error) {
+	data, err := json.Marshal(elev)
 	if err != nil {
-		log.Printf("No file with path '%s' exists\n", fileName)
-		return elevator.NewElevator(Nfloors, Nbuttons)
+		return nil, err
 	}
-	defer file.Close()
+	return encode(data, 0)
+}
+
+func encode(data []byte, generation uint64) ([]byte, error) {
+	return json.Marshal(backup{
+		Version:    schemaVersion,
+		Generation: generation,
+		Timestamp:  time.Now().UnixNano(),
+		Checksum:   checksum(data),
+		Elevator:   data,
+	})
+}
 
+// Decode verifies and migrates data in the backup format, and returns the
+// elevator stored in it.
+func Decode(data []byte) (elevator.Elevator, error) {
+	_, elev, err := decodeBackup(data)
+	return elev, err
+}
+
+func decodeBackup(data []byte) (backup, elevator.Elevator, error) {
+	var b backup
 	var elev elevator.Elevator
-	data, _ := ioutil.ReadAll(file)
-	err = json.Unmarshal([]byte(data), &elev)
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, elev, err
+	}
+	switch {
+	case b.Checksum == "":
+		// file from before checksums were added, the elevator is stored
+		// directly
+		b.Version = 0
+		b.Elevator = data
+	case b.Version == 0:
+		// checksum but no version
+		b.Version = 1
+	}
+	if b.Version > 0 && checksum(b.Elevator) != b.Checksum {
+		return b, elev, errors.New("checksum mismatch")
+	}
+
+	elev, err := decode(b.Elevator, b.Version)
+	return b, elev, err
+}
+
+// readFile reads, verifies and migrates one backup file.
+func readFile(fileName string) (backup, elevator.Elevator, error) {
+	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Println("Error converting backup JSON to elevator object.")
-		return elevator.NewElevator(Nfloors, Nbuttons)
+		return backup{}, elevator.Elevator{}, err
+	}
+	return decodeBackup(data)
+}
+
+// Generations lists all backup generations of fileName, newest first. Each
+// generation is verified, see Generation.Err.
+func Generations(fileName string) []Generation {
+	paths, _ := filepath.Glob(fileName + ".*")
+
+	var gens []Generation
+	for _, path := range paths {
+		n, err := strconv.ParseUint(strings.TrimPrefix(path, fileName+"."), 10, 64)
+		if err != nil {
+			continue // not a generation, e.g. a temporary file
+		}
+		g := Generation{Number: n, FileName: path}
+		var b backup
+		b, _, g.Err = readFile(path)
+		g.Timestamp = time.Unix(0, b.Timestamp)
+		g.Checksum = b.Checksum
+		gens = append(gens, g)
 	}
 
-	log.Println("Read old configuration from file")
-	log.Println(elev.ToString())
-	log.Println(elev.OrderMatrixToString())
-	return elev
+	sort.Slice(gens, func(i, j int) bool { return gens[i].Number > gens[j].Number })
+	return gens
+}
+
+// ReadGeneration reads a single generation of fileName.
+func ReadGeneration(fileName string, number uint64) (elevator.Elevator, error) {
+	_, elev, err := readFile(generationFileName(fileName, number))
+	return elev, err
 }
 
-func Write(fileName string, elev elevator.Elevator) {
-	os.Remove(fileName)
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0644)
+// Read reads the elevator from the newest valid backup generation. Files from
+// before generations were added are used if there are no valid generations.
+// ErrNoBackup is returned if there is no valid backup at all.
+func Read(fileName string) (elevator.Elevator, error) {
+	var candidates []string
+	for _, g := range Generations(fileName) {
+		if g.Err != nil {
+			log.Printf("Skipping backup '%s': %v\n", g.FileName, g.Err)
+			continue
+		}
+		candidates = append(candidates, g.FileName)
+	}
+	candidates = append(candidates, fileName, fileName+".prev")
+
+	for _, name := range candidates {
+		_, elev, err := readFile(name)
+		if err == nil {
+			log.Printf("Read old configuration from file '%s'\n", name)
+			return elev, nil
+		}
+	}
+	return elevator.Elevator{}, ErrNoBackup
+}
+
+// syncDir fsyncs the directory dir so that renames in it are persisted.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeTemp writes data to a temporary file next to fileName and fsyncs it.
+// The name of the temporary file is returned.
+func writeTemp(fileName string, data []byte) (string, error) {
+	tmpName := fileName + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return "", err
+	}
+	return tmpName, file.Close()
+}
+
+// Writer writes the backup generations of one file. It remembers what it
+// last wrote, so that unchanged state isn't written as a new generation. Only
+// one Writer should write to a file, and it must not be used from several
+// goroutines at once.
+type Writer struct {
+	fileName string
+	next     uint64
+	checksum string
+}
+
+// NewWriter returns a writer for fileName, continuing after the newest
+// generation on disk.
+func NewWriter(fileName string) *Writer {
+	w := &Writer{fileName: fileName, next: 1}
+	if gens := Generations(fileName); len(gens) > 0 {
+		w.next = gens[0].Number + 1
+	}
+	return w
+}
+
+// writeGeneration writes data as a new generation. The file is written to a
+// temporary file and renamed into place, so a crash at any point leaves the
+// older generations intact. Generations beyond the ones to keep are removed.
+func (w *Writer) writeGeneration(data []byte) error {
+	msg, err := encode(data, w.next)
+	if err != nil {
+		return err
+	}
+
+	tmpName, err := writeTemp(w.fileName, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, generationFileName(w.fileName, w.next)); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(w.fileName)); err != nil {
+		return err
+	}
+	w.next++
+	w.checksum = checksum(data)
+
+	for i, g := range Generations(w.fileName) {
+		if i >= generationsToKeep {
+			os.Remove(g.FileName)
+		}
+	}
+	return nil
+}
+
+// Write writes elev as a new backup generation, unless it's the same as the
+// last one written.
+func (w *Writer) Write(elev elevator.Elevator) error {
+	data, err := json.Marshal(elev)
 	if err != nil {
-		log.Println("Error creating backup file")
-		return
+		return fmt.Errorf("converting elevator object to JSON: %w", err)
 	}
-	defer file.Close()
+	if checksum(data) == w.checksum {
+		return nil
+	}
+	if err := w.writeGeneration(data); err != nil {
+		return fmt.Errorf("writing backup file: %w", err)
+	}
+	return nil
+}
 
-	msg, err := json.Marshal(elev)
+// Restore writes generation number again as the newest generation, so that
+// it's used on the next start.
+func (w *Writer) Restore(number uint64) error {
+	elev, err := ReadGeneration(w.fileName, number)
 	if err != nil {
-		log.Println("Error converting elevator object to JSON.")
-		return
+		return fmt.Errorf("generation %d: %w", number, err)
 	}
-	if _, err := file.Write([]byte(msg)); err != nil {
-		log.Println("Error writing elevator JSON to backup file.")
-		return
+	data, err := json.Marshal(elev)
+	if err != nil {
+		return err
 	}
+	return w.writeGeneration(data)
 }
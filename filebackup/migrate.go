@@ -0,0 +1,110 @@
+package filebackup
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"../elevTypes/elevator"
+)
+
+// schemaVersion is the version of the elevator format written to backups. It
+// must be increased, and a migration added, whenever a change to
+// elevator.Elevator or order.Order changes what is stored.
+//
+// Versions:
+//
+//	0: elevator stored directly in the file, no checksum
+//	1: elevator stored with a checksum, no version field
+//	2: version field added
+//	3: every cell of the order matrix has the floor and type of its position
+const schemaVersion int = 3
+
+// document is an elevator decoded as generic JSON, so that a migration can
+// rename, move or fill in fields before it's decoded into the current type.
+type document map[string]interface{}
+
+// migration upgrades a document by one version.
+type migration func(doc document) error
+
+// migrations[n] upgrades a document from version n to n+1.
+var migrations = []migration{
+	0: migrateFileFormat,
+	1: migrateFileFormat,
+	2: stampCells,
+}
+
+// migrateFileFormat is used when only the file around the elevator changed,
+// not the elevator itself.
+func migrateFileFormat(doc document) error {
+	return nil
+}
+
+// stampCells sets the floor and type of every cell of the order matrix to
+// its position. Cells that were never used used to be left as zero values,
+// which look like a HallUp order at floor 0.
+func stampCells(doc document) error {
+	rows, ok := doc["Orders"].([]interface{})
+	if !ok {
+		return fmt.Errorf("Orders is %T, not a matrix", doc["Orders"])
+	}
+	for f, row := range rows {
+		cells, ok := row.([]interface{})
+		if !ok {
+			return fmt.Errorf("Orders at floor %d is %T, not a list", f, row)
+		}
+		for t, cell := range cells {
+			o, ok := cell.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("order %d at floor %d is %T, not an order", t, f, cell)
+			}
+			o["Floor"], o["Type"] = f, t
+		}
+	}
+	return nil
+}
+
+// decode migrates data from version to schemaVersion and decodes it.
+func decode(data []byte, version int) (elevator.Elevator, error) {
+	var elev elevator.Elevator
+	if version > schemaVersion {
+		return elev, fmt.Errorf("written by a newer version (schema %d, this is %d)",
+			version, schemaVersion)
+	}
+	if version < 0 || len(migrations) != schemaVersion {
+		return elev, fmt.Errorf("no migration from schema version %d", version)
+	}
+
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return elev, err
+	}
+	for v := version; v < schemaVersion; v++ {
+		if err := migrations[v](doc); err != nil {
+			return elev, fmt.Errorf("migrating from schema %d to %d: %w", v, v+1, err)
+		}
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return elev, err
+	}
+	if err := json.Unmarshal(migrated, &elev); err != nil {
+		return elev, err
+	}
+	return elev, validate(elev)
+}
+
+// validate checks that the order matrix matches the size of the elevator.
+func validate(elev elevator.Elevator) error {
+	if len(elev.Orders) != elev.Nfloors {
+		return fmt.Errorf("order matrix has %d floors, expected %d",
+			len(elev.Orders), elev.Nfloors)
+	}
+	for f := range elev.Orders {
+		if len(elev.Orders[f]) != elev.Nbuttons {
+			return fmt.Errorf("order matrix has %d buttons at floor %d, expected %d",
+				len(elev.Orders[f]), f, elev.Nbuttons)
+		}
+	}
+	return nil
+}
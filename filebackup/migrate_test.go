@@ -0,0 +1,64 @@
+package filebackup
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+)
+
+// The fixtures in testdata are the same elevator written by older versions:
+// moving up past floor 1 to a cab order at floor 2, with a finished HallUp
+// order at floor 1. The cells that were never used are zero values.
+func TestMigrate(t *testing.T) {
+	for _, name := range []string{"v0.json", "v1.json", "v2.json"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		elev, err := Decode(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if elev.Floor != 1 || elev.Direction != elevator.Up || elev.State != elevator.Moving ||
+			elev.ActiveOrder.Floor != 2 || elev.ActiveOrder.Status != order.Execute {
+			t.Errorf("%s: got %s, want moving up from floor 1 to floor 2", name, elev.ToString())
+		}
+		for f := range elev.Orders {
+			for typ, o := range elev.Orders[f] {
+				if o.Floor != f || o.Type != order.Type(typ) {
+					t.Errorf("%s: cell [%d][%d] is %s, want its own floor and type",
+						name, f, typ, o.ToString())
+				}
+			}
+		}
+		want := map[[2]int]order.Status{
+			{2, int(order.Cab)}:    order.Execute,
+			{1, int(order.HallUp)}: order.Finished,
+		}
+		for f := range elev.Orders {
+			for typ, o := range elev.Orders[f] {
+				if o.Status != want[[2]int{f, typ}] {
+					t.Errorf("%s: cell [%d][%d] has status %d, want %d",
+						name, f, typ, o.Status, want[[2]int{f, typ}])
+				}
+			}
+		}
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	data, err := Encode(elevator.NewElevator(4, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := strings.Replace(string(data), `"Version":3`, `"Version":4`, 1)
+	if _, err := Decode([]byte(newer)); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("decoding a backup from a newer version gave %v, want an error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package group
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Group runs the long-running goroutines that make up a program or a
+// component, like errgroup. The goroutines are expected to run until their
+// context is cancelled, so as soon as one of them returns, with or without an
+// error, the context of the others is cancelled.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+// WithContext returns a new group and the context its goroutines run with,
+// which is cancelled when parent is, or when one of the goroutines returns.
+func WithContext(parent context.Context) (*Group, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	return &Group{ctx: ctx, cancel: cancel}, ctx
+}
+
+// Go runs fn in a new goroutine. name is used in the log and in the error
+// returned by Wait.
+func (g *Group) Go(name string, fn func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.cancel()
+		if err := fn(g.ctx); err != nil {
+			log.Printf("%s stopped: %v\n", name, err)
+			g.errOnce.Do(func() { g.err = fmt.Errorf("%s: %w", name, err) })
+		}
+	}()
+}
+
+// Wait waits for all goroutines to return and returns the first error.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
@@ -0,0 +1,93 @@
+package health
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// component is the last reported progress of one subsystem.
+type component struct {
+	timeout  time.Duration
+	lastBeat time.Time
+	err      error
+}
+
+var (
+	mtx        sync.Mutex
+	components = make(map[string]*component)
+)
+
+// Name returns the name of the component name of the elevator id, so that
+// several elevators in one process don't share components. An empty id gives
+// name.
+func Name(id, name string) string {
+	if id == "" {
+		return name
+	}
+	return id + "/" + name
+}
+
+// Register adds a required component to the registry. The component is
+// unhealthy if it hasn't called Beat within timeout. It gets one timeout from
+// now to report for the first time. A component with a zero timeout doesn't
+// need to call Beat, and is only unhealthy after Fail.
+func Register(name string, timeout time.Duration) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	components[name] = &component{timeout: timeout, lastBeat: time.Now()}
+}
+
+// Unregister removes a component that has stopped on purpose, so that it's no
+// longer required.
+func Unregister(name string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	delete(components, name)
+}
+
+// Beat reports that the component has made progress, and clears any error
+// reported with Fail. Beats from components that aren't registered are
+// ignored, so packages can report progress without knowing if anyone checks.
+func Beat(name string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if c, ok := components[name]; ok {
+		c.lastBeat = time.Now()
+		c.err = nil
+	}
+}
+
+// Fail marks the component as unhealthy until its next Beat.
+func Fail(name string, err error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if c, ok := components[name]; ok {
+		c.err = err
+	}
+}
+
+// Check returns an error naming every unhealthy component, or nil if all
+// registered components are healthy.
+func Check() error {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	now := time.Now()
+	var problems []string
+	for name, c := range components {
+		if c.err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, c.err))
+		} else if silent := now.Sub(c.lastBeat); c.timeout > 0 && silent > c.timeout {
+			problems = append(problems, fmt.Sprintf("%s: no progress for %s",
+				name, silent.Round(time.Millisecond)))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("unhealthy components: %s", strings.Join(problems, ", "))
+}
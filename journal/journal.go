@@ -0,0 +1,222 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+	"../events"
+)
+
+// EventType is the kind of state change an Event records.
+type EventType int
+
+const (
+	// ButtonPress is a button pressed on this elevator.
+	ButtonPress EventType = 1
+	// OrderChange is a new status for an order in the order matrix.
+	OrderChange EventType = 2
+	// FloorArrival is the elevator reaching a floor.
+	FloorArrival EventType = 3
+	// ActiveOrderChange is a new active order or a new status for it.
+	ActiveOrderChange EventType = 4
+	// StateChange is a new state or direction.
+	StateChange EventType = 5
+)
+
+// Event is one state change. Which fields are used depends on Type. Every
+// event holds the new value rather than a difference, so replaying an event
+// twice gives the same state.
+type Event struct {
+	Type      EventType
+	Order     order.Order
+	Floor     int                `json:",omitempty"`
+	State     elevator.State     `json:",omitempty"`
+	Direction elevator.Direction `json:",omitempty"`
+}
+
+// Journal is an append-only file of events. It's truncated when the state is
+// compacted into a snapshot.
+type Journal struct {
+	fileName string
+	file     *os.File
+	entries  int
+}
+
+// FileName returns the journal file belonging to a backup or store file.
+func FileName(storeFileName string) string {
+	return storeFileName + ".journal"
+}
+
+// Open opens the journal for appending, creating it if it doesn't exist. An
+// empty fileName gives a journal that only counts the events, for a store
+// that keeps nothing on disk.
+func Open(fileName string) (*Journal, error) {
+	if fileName == "" {
+		return &Journal{}, nil
+	}
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{fileName: fileName, file: file}, nil
+}
+
+// Append writes events to the journal, one JSON object per line, and syncs
+// the file before returning.
+func (j *Journal) Append(events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, ev := range events {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	if j.file == nil {
+		j.entries += len(events)
+		return nil
+	}
+	if _, err := j.file.Write(buf); err != nil {
+		return err
+	}
+	j.entries += len(events)
+	return j.file.Sync()
+}
+
+// Kinds is the kinds of bus events the journal records, see Record.
+var Kinds = []events.Kind{events.OrderRequested, events.ElevatorChanged}
+
+// Record appends the journal events for a bus event of one of Kinds: a button
+// press for OrderRequested, and the difference between the states for
+// ElevatorChanged. It's meant to observe the bus, see events.Bus.Observe.
+func (j *Journal) Record(ev events.Event) error {
+	switch ev.Kind {
+	case events.OrderRequested:
+		return j.Append(Event{Type: ButtonPress, Order: ev.Order})
+	case events.ElevatorChanged:
+		return j.Append(Diff(ev.Previous, ev.Elevator)...)
+	}
+	return nil
+}
+
+// Entries returns how many events have been appended since the journal was
+// opened or last truncated.
+func (j *Journal) Entries() int {
+	return j.entries
+}
+
+// Truncate empties the journal. It must only be called after the state has
+// been written to a snapshot.
+func (j *Journal) Truncate() error {
+	if j.file == nil {
+		j.entries = 0
+		return nil
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.entries = 0
+	return j.file.Sync()
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// Apply returns elev with ev applied.
+func Apply(elev elevator.Elevator, ev Event) (elevator.Elevator, error) {
+	switch ev.Type {
+	case ButtonPress, OrderChange:
+		o := ev.Order
+		if o.Floor < 0 || o.Floor >= len(elev.Orders) ||
+			int(o.Type) < 0 || int(o.Type) >= len(elev.Orders[o.Floor]) {
+			return elev, fmt.Errorf("order %s outside order matrix", o.ToString())
+		}
+		elev.AssignOrderToMatrix(o)
+	case FloorArrival:
+		elev.Floor = ev.Floor
+	case ActiveOrderChange:
+		elev.ActiveOrder = ev.Order
+	case StateChange:
+		elev.State = ev.State
+		elev.Direction = ev.Direction
+	default:
+		return elev, fmt.Errorf("unknown event type %d", ev.Type)
+	}
+	return elev, nil
+}
+
+// Replay applies all events in the journal fileName to elev, which should be
+// the last snapshot. Replay stops at the first line that can't be decoded,
+// since that is a write that was cut short by a crash. Returns the new state
+// and the number of events applied. An empty fileName has no events.
+func Replay(fileName string, elev elevator.Elevator) (elevator.Elevator, int, error) {
+	if fileName == "" {
+		return elev, 0, nil
+	}
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return elev, 0, nil
+	} else if err != nil {
+		return elev, 0, err
+	}
+	defer file.Close()
+
+	elev = elev.Copy()
+	n := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			log.Printf("Journal '%s' ends with a partial entry after %d events\n", fileName, n)
+			break
+		}
+		if elev, err = Apply(elev, ev); err != nil {
+			log.Printf("Skipping journal entry %d: %v\n", n+1, err)
+			continue
+		}
+		n++
+	}
+	return elev, n, scanner.Err()
+}
+
+// Diff returns the events that turn old into new.
+func Diff(old, new elevator.Elevator) []Event {
+	var diff []Event
+	for f := range new.Orders {
+		for t := range new.Orders[f] {
+			o := new.Orders[f][t]
+			if f >= len(old.Orders) || t >= len(old.Orders[f]) ||
+				!order.CompareEq(old.Orders[f][t], o) {
+				// a cell that was never pressed doesn't know its floor and
+				// type, and Apply finds the cell by them
+				o.Floor, o.Type = f, order.Type(t)
+				diff = append(diff, Event{Type: OrderChange, Order: o})
+			}
+		}
+	}
+	if old.Floor != new.Floor {
+		diff = append(diff, Event{Type: FloorArrival, Floor: new.Floor})
+	}
+	if !order.CompareEq(old.ActiveOrder, new.ActiveOrder) {
+		diff = append(diff, Event{Type: ActiveOrderChange, Order: new.ActiveOrder})
+	}
+	if old.State != new.State || old.Direction != new.Direction {
+		diff = append(diff, Event{Type: StateChange,
+			State: new.State, Direction: new.Direction})
+	}
+	return diff
+}
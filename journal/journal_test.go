@@ -0,0 +1,95 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+	"../events"
+)
+
+func TestReplayUnpressedCell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "elevator.journal")
+
+	snapshot := elevator.NewElevator(4, 3)
+	snapshot.Orders[0][order.HallUp] = order.Order{
+		Floor: 0, Type: order.HallUp, Status: order.NotTaken}
+
+	// the cab cell at floor 2 is finished without ever being pressed, so
+	// only its status is set
+	elev := snapshot.Copy()
+	elev.Orders[2][order.Cab].Status = order.Finished
+
+	j, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Append(Diff(snapshot, elev)...); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	replayed, n, err := Replay(fileName, snapshot.Copy())
+	if err != nil || n != 1 {
+		t.Fatalf("Replay applied %d events with error %v, want 1 and no error", n, err)
+	}
+	if o := replayed.Orders[2][order.Cab]; o.Status != order.Finished {
+		t.Errorf("cab order at floor 2 is %s after replay, want Finished", o.ToString())
+	}
+	if o := replayed.Orders[0][order.HallUp]; o.Status != order.NotTaken {
+		t.Errorf("HallUp order at floor 0 is %s after replay, want NotTaken", o.ToString())
+	}
+}
+
+func TestRecordBusEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "elevator.journal")
+
+	j, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := events.NewBus()
+	bus.Observe(func(ev events.Event) {
+		if err := j.Record(ev); err != nil {
+			t.Error(err)
+		}
+	}, Kinds...)
+
+	snapshot := elevator.NewElevator(4, 3)
+	press := order.Order{Floor: 3, Type: order.Cab, Status: order.Execute}
+	bus.Publish(events.Event{Kind: events.OrderRequested, Order: press})
+	elev := snapshot.Copy()
+	elev.Floor = 1
+	elev.Orders[2][order.HallDown].Status = order.NotTaken
+	bus.Publish(events.Event{Kind: events.ElevatorChanged, Previous: snapshot, Elevator: elev})
+	// not recorded
+	bus.Publish(events.Event{Kind: events.FloorReached, Floor: 2})
+	j.Close()
+
+	replayed, n, err := Replay(fileName, snapshot.Copy())
+	if err != nil || n != 3 {
+		t.Fatalf("Replay applied %d events with error %v, want 3 and no error", n, err)
+	}
+	if o := replayed.Orders[3][order.Cab]; o.Status != order.Execute {
+		t.Errorf("cab order at floor 3 is %s after replay, want Execute", o.ToString())
+	}
+	if o := replayed.Orders[2][order.HallDown]; o.Status != order.NotTaken {
+		t.Errorf("HallDown order at floor 2 is %s after replay, want NotTaken", o.ToString())
+	}
+	if replayed.Floor != 1 {
+		t.Errorf("floor is %d after replay, want 1", replayed.Floor)
+	}
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Level decides which messages are logged.
+type Level int32
+
+const (
+	// Debug logs everything, including the elevator state after every change
+	// and periodic statistics.
+	Debug Level = 0
+	// Info leaves out the debug messages.
+	Info Level = 1
+)
+
+// Levels is the names accepted by Parse, from the most to the least verbose.
+var Levels = []string{"debug", "info"}
+
+// level is the current Level. It's changed while the program runs, see
+// SetLevel.
+var level int32
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(Levels) {
+		return Levels[l]
+	}
+	return fmt.Sprintf("invalid (%d)", int(l))
+}
+
+// Parse returns the level named s.
+func Parse(s string) (Level, error) {
+	for i, name := range Levels {
+		if name == s {
+			return Level(i), nil
+		}
+	}
+	return Debug, fmt.Errorf("unknown log level '%s', must be one of %v", s, Levels)
+}
+
+// SetLevel changes the level. It can be called at any time.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Debugf logs like log.Printf if the level is Debug.
+func Debugf(format string, args ...interface{}) {
+	if Level(atomic.LoadInt32(&level)) <= Debug {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
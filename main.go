@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
+	"./config"
 	"./control"
+	"./driver/elevio"
+	"./driver/fsm"
+	"./group"
+	"./logging"
+	"./network"
+	"./request"
+	"./store"
 	"./watchdog"
 )
 
@@ -32,30 +42,205 @@ func setupSignals() chan os.Signal {
 	return sigs
 }
 
-func parseFlags() (port, nfloors, wdPort int, wdMsg string, readFile bool) {
-	portF := flag.Int("port", 15657, "Port for connecting to ElevatorServer/SimElevatorServer")
-	nfloorsF := flag.Int("floors", 4, "Number of floors per elevator")
-	readFileF := flag.Bool("fromfile", false, "Read Elevator struct from file if this flag is passed")
-	wdPortF := flag.Int("wd", 57005, "Port to communicate with watchdog program")
-	wdMsgF := flag.String("wdmsg", "28-IAmAlive",
-		"String to send to watchdog to indicate the program is up and running")
-	flag.Parse()
+// defineFlags defines the flags on fs, each overriding the setting in cfg it's
+// bound to when given.
+func defineFlags(fs *flag.FlagSet, cfg *config.Config) (configFile *string, printConfig *bool) {
+	configFile = fs.String("config", "", "JSON file to read the settings from, "+
+		"overridden by the flags given")
+	printConfig = fs.Bool("print-config", false,
+		"Print the effective configuration as JSON and exit")
 
-	port = *portF
-	nfloors = *nfloorsF
-	wdPort = *wdPortF
-	wdMsg = *wdMsgF
-	readFile = *readFileF
+	fs.IntVar(&cfg.Elevator.Port, "port", cfg.Elevator.Port,
+		"Port for connecting to ElevatorServer/SimElevatorServer")
+	fs.IntVar(&cfg.Elevator.Floors, "floors", cfg.Elevator.Floors, "Number of floors per elevator")
+	fs.BoolVar(&cfg.Elevator.FromFile, "fromfile", cfg.Elevator.FromFile,
+		"Read Elevator struct from file if this flag is passed")
+	fs.StringVar(&cfg.Elevator.Store, "store", cfg.Elevator.Store, fmt.Sprintf(
+		"Backend for persisting the elevator state, one of %v", store.Backends))
+	fs.IntVar(&cfg.Watchdog.Port, "wd", cfg.Watchdog.Port,
+		"Port to communicate with watchdog program")
+	fs.StringVar(&cfg.Watchdog.Message, "wdmsg", cfg.Watchdog.Message,
+		"String to send to watchdog to indicate the program is up and running")
+	fs.StringVar(&cfg.Watchdog.Mode, "wdmode", cfg.Watchdog.Mode, fmt.Sprintf(
+		"Watchdog protocol, one of %v. systemd uses sd_notify over $NOTIFY_SOCKET",
+		watchdog.Modes))
+	fs.IntVar(&cfg.Network.Port, "netport", cfg.Network.Port,
+		"Port for communicating with the other elevators")
+	fs.IntVar(&cfg.Network.OrderCopies, "ordercopies", cfg.Network.OrderCopies,
+		"Number of copies sent of each order message")
+	fs.Var(&cfg.Driver.DoorTime, "doortime", "How long the door stays open")
+	fs.Var(&cfg.Driver.FloorChangeTimeout, "floortimeout",
+		"How long the car can drive without reaching a floor")
+	fs.Var(&cfg.Driver.FindFloorTimeout, "findfloortimeout",
+		"How long to drive each way looking for a floor at startup")
+	fs.Var(&cfg.Orders.Timeout, "ordertimeout", "How long an order can be taken before "+
+		"it must be finished")
+	fs.Var(&cfg.Orders.DistancePenalty, "distpenalty",
+		"Extra wait per floor of distance before claiming an order")
+	fs.Var(&cfg.Orders.Backoff, "backoff",
+		"Largest random change of the wait before claiming an order")
+	fs.BoolVar(&cfg.EventLog, "eventlog", cfg.EventLog, "Write every elevator event to the log")
+	fs.StringVar(&cfg.LogLevel, "loglevel", cfg.LogLevel, fmt.Sprintf(
+		"How much to log, one of %v", logging.Levels))
 	return
 }
 
+// flagValues is the flags given on the command line by name, with their
+// values as parsed at startup. They override the config file, both at startup
+// and when it's reloaded.
+type flagValues map[string]string
+
+// apply sets the settings bound to the flags in fv on cfg.
+func (fv flagValues) apply(cfg *config.Config) error {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	defineFlags(fs, cfg)
+	for name, value := range fv {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads the config file at path, if any, and applies flags on top
+// of it. Returns the result, which is validated, and the configuration given
+// by the file alone.
+func loadConfig(path string, flags flagValues) (cfg, file config.Config, err error) {
+	file = config.Default()
+	if path != "" {
+		if file, err = config.Load(path); err != nil {
+			return file, file, err
+		}
+	}
+	cfg = file
+	if err := flags.apply(&cfg); err != nil {
+		return cfg, file, err
+	}
+	return cfg, file, cfg.Validate()
+}
+
+// parseFlags parses the command line and returns the configuration given by
+// the config file and the flags, the path of the config file and the flags
+// given, see loadConfig.
+func parseFlags() (config.Config, string, flagValues) {
+	cfg := config.Default()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configFile, printConfig := defineFlags(fs, &cfg)
+	if err := fs.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(watchdog.ExitStopped)
+	} else if err != nil {
+		os.Exit(watchdog.ExitUsage)
+	}
+	flags := make(flagValues)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "print-config" {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+
+	cfg, _, err := loadConfig(*configFile, flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load configuration: %v\n", err)
+		os.Exit(watchdog.ExitUsage)
+	}
+	if *printConfig {
+		fmt.Println(cfg.String())
+		os.Exit(watchdog.ExitStopped)
+	}
+	return cfg, *configFile, flags
+}
+
+// newController connects to the elevator server and creates the controller
+// for this elevator. The connection is closed by the caller when the
+// controller has stopped.
+func newController(conf config.Config) (*control.Controller, *elevio.Conn, error) {
+	elevIOport := conf.Elevator.Port
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	id := fmt.Sprintf("%s-%d", hostname, elevIOport)
+
+	io, err := elevio.Dial(fmt.Sprintf("localhost:%d", elevIOport), conf.Elevator.Floors, id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to elevator server: %w", err)
+	}
+	st, err := store.Open(conf.Elevator.Store, elevIOport)
+	if err != nil {
+		io.Close()
+		return nil, nil, fmt.Errorf("opening store: %w", err)
+	}
+
+	cfg := control.Config{
+		ID:          id,
+		Nfloors:     conf.Elevator.Floors,
+		Nbuttons:    3,
+		Restore:     conf.Elevator.FromFile,
+		OrderCopies: conf.Network.OrderCopies,
+		EventLog:    conf.EventLog,
+		Settings:    conf.Settings(),
+	}
+	udp := network.UDP{Port: conf.Network.Port, ID: id, LogID: "port" + strconv.Itoa(elevIOport)}
+	deps := control.Dependencies{
+		IO:        io,
+		Network:   udp,
+		Store:     st,
+		Scheduler: &request.Scheduler{},
+	}
+	c, err := control.New(cfg, deps)
+	if err != nil {
+		io.Close()
+		st.Close()
+		return nil, nil, err
+	}
+	return c, io, nil
+}
+
 func main() {
-	elevIOport, nfloors, wdPort, wdMsg, readFile := parseFlags()
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		os.Exit(backupCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsm" {
+		// render the elevator state machine, e.g. ./heis fsm | dot -Tpng
+		fmt.Print(fsm.Dot())
+		os.Exit(watchdog.ExitStopped)
+	}
+
+	cfg, configFile, flags := parseFlags()
 	setupLog()
+	logging.SetLevel(cfg.Level())
 	pid := getPID()
-	watchdog.Setup(fmt.Sprintf("%s:%d", wdMsg, pid), wdPort)
+	wd := cfg.Watchdog
+	if err := watchdog.Setup(wd.Mode, fmt.Sprintf("%s:%d", wd.Message, pid), wd.Port); err != nil {
+		if wd.Mode == "udp" {
+			log.Fatalf("Could not start watchdog: %v. Is another elevator using "+
+				"port %d?\n", err, wd.Port)
+		}
+		log.Fatalf("Could not start watchdog: %v\n", err)
+	}
 	sigs := setupSignals()
 
-	control.Setup(elevIOport, nfloors, readFile)
-	control.Loop(sigs)
+	c, io, err := newController(cfg)
+	if err != nil {
+		log.Fatalf("Could not start control module: %v\n", err)
+	}
+
+	// Everything runs until the controller has shut down or a part of it
+	// fails, and then the rest is stopped and waited for before exiting.
+	code := watchdog.ExitRestart
+	g, _ := group.WithContext(context.Background())
+	g.Go("watchdog", watchdog.Run)
+	g.Go("config reload", func(ctx context.Context) error {
+		return watchConfig(ctx, c, cfg, configFile, flags)
+	})
+	g.Go("controller", func(ctx context.Context) error {
+		var err error
+		code, err = c.Run(ctx, sigs)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		log.Printf("Stopped because of an error: %v\n", err)
+	}
+	io.Close()
+	os.Exit(code)
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"./config"
+)
+
+// TestPrintConfig reads back what --print-config prints for a set of flags
+// with --config, which must give the same configuration.
+func TestPrintConfig(t *testing.T) {
+	cfg := config.Default()
+	fs := flag.NewFlagSet("elevator", flag.ContinueOnError)
+	defineFlags(fs, &cfg)
+	args := []string{"-floors", "6", "-store", "kv", "-wdmode", "systemd",
+		"-ordercopies", "5", "-doortime", "1500ms", "-backoff", "250ms", "-eventlog",
+		"-loglevel", "info"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	flags := make(flagValues)
+	fs.Visit(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+	printed, _, err := loadConfig("", flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(printed.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatalf("loading the printed configuration: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, printed) {
+		t.Errorf("loaded %s\nwant %s", loaded, printed)
+	}
+	if loaded.Elevator.Floors != 6 || loaded.Driver.DoorTime.String() != "1.5s" {
+		t.Errorf("flags not applied, got %s", loaded)
+	}
+}
@@ -1,8 +1,10 @@
 package bcast
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
 	"os"
@@ -10,8 +12,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"../conn"
 )
 
 const (
@@ -20,18 +20,59 @@ const (
 	// Times to resend a network package
 	timesToResendMessage int    = 10
 	networkLogFile       string = "network.log"
+	// How many message ids per type to remember when filtering duplicates
+	duplicateWindow int = 64
+	// The largest UDP payload over IPv4. Larger messages can't be sent
+	maxMessageSize int = 65507
+	// How long the receiver waits after a failed read. The wait doubles on
+	// every failure in a row, up to readBackoffMax
+	readBackoffMin time.Duration = 10 * time.Millisecond
+	readBackoffMax time.Duration = 1 * time.Second
+	// The sender field of a message holds this many decimal digits
+	senderLength int = 6
+	senderLimit  int = 1000000
 )
 
-var (
-	logFile *os.File
-	logger  *log.Logger
-)
+// SenderID returns the sender number of the messages sent by the elevator id,
+// which its own receiver drops. Elevators run in one process get different
+// numbers, unlike with the process id.
+func SenderID(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(senderLimit))
+}
+
+// Logger writes what one network sends and receives to its own file, see
+// NewLogger. A nil Logger writes errors to the standard logger and drops the
+// rest.
+type Logger struct {
+	file *os.File
+	log  *log.Logger
+}
+
+// message logs msg with prefix, but filters out IAmAlive messages.
+func (l *Logger) message(msg string, prefix string) {
+	if l != nil && !strings.Contains(msg, "IAmAlive") {
+		l.log.Println(prefix + ": " + msg)
+	}
+}
+
+// errorf logs to the network log file, or to the standard logger for a nil
+// Logger.
+func (l *Logger) errorf(format string, v ...interface{}) {
+	if l != nil {
+		l.log.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
 
-// logMessage logs msg with prefix, but filters out IAmAlive messages.
-func logMessage(msg string, prefix string) {
-	if !strings.Contains(msg, "IAmAlive") {
-		logger.Println(prefix + ": " + msg)
+// Close closes the log file.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
 	}
+	return l.file.Close()
 }
 
 // function for finding the first null termination in a byte array
@@ -44,48 +85,58 @@ func clen(n []byte) int {
 	return len(n)
 }
 
-// InitLogger initalizes the logger object and file
-func InitLogger(logID string) {
-	if logger == nil {
-		// fmt.Println("Initializing logger")
-		cwd, _ := os.Getwd()
-		logDirPath := cwd + "/logs/"
-		logFilePath := logDirPath + fmt.Sprintf("%s_", logID) + networkLogFile
+// NewLogger creates the log file of the network named logID in logs/,
+// replacing an old one. Returns nil if the file can't be created.
+func NewLogger(logID string) *Logger {
+	cwd, _ := os.Getwd()
+	logDirPath := cwd + "/logs/"
+	logFilePath := logDirPath + fmt.Sprintf("%s_", logID) + networkLogFile
 
-		err := os.MkdirAll(logDirPath, 0755)
-		if err != nil {
-			fmt.Printf("Error creating log directory at %s\n", logDirPath)
-			return
-		}
+	err := os.MkdirAll(logDirPath, 0755)
+	if err != nil {
+		fmt.Printf("Error creating log directory at %s\n", logDirPath)
+		return nil
+	}
 
-		//remove old log file
-		os.Remove(logFilePath)
-		logFile, err = os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC, 0655)
-		if err != nil {
-			fmt.Printf("Error opening info log file at %s\n", logFilePath)
-			return
-		}
-		_ = logFile
-		logger = log.New(logFile, "", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	//remove old log file
+	os.Remove(logFilePath)
+	logFile, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC, 0655)
+	if err != nil {
+		fmt.Printf("Error opening info log file at %s\n", logFilePath)
+		return nil
 	}
+	return &Logger{file: logFile,
+		log: log.New(logFile, "", log.Ldate|log.Lmicroseconds|log.Lshortfile)}
 }
 
-// check if same timestamp is the same as the last received message for this type of message
-// if current timestamp is equal to last time stamp, don't decode message
-func isDuplicate(timestamp string, timestampMap *map[reflect.Type]string, msg string, Type reflect.Type) bool {
-	if v, ok := (*timestampMap)[Type]; ok {
-		if v != timestamp {
-
-			(*timestampMap)[Type] = timestamp
-			logMessage(msg, "Received message")
-		} else {
-			return true
-		}
+// recentMessages remembers the ids of the last received messages of one type.
+// Copies of a message are spread out in time, so copies of other messages can
+// arrive in between.
+type recentMessages struct {
+	ids  map[string]bool
+	ring [duplicateWindow]string
+	next int
+}
 
-	} else {
-		logMessage(msg, "Received message")
-		(*timestampMap)[Type] = timestamp
+// check if a message with the same id has been received recently for this
+// type of message. if so, don't decode message
+func isDuplicate(logger *Logger, id string, recentMap map[reflect.Type]*recentMessages,
+	msg string, Type reflect.Type) bool {
+	recent, ok := recentMap[Type]
+	if !ok {
+		recent = &recentMessages{ids: make(map[string]bool)}
+		recentMap[Type] = recent
+	}
+	if recent.ids[id] {
+		return true
 	}
+
+	delete(recent.ids, recent.ring[recent.next])
+	recent.ring[recent.next] = id
+	recent.ids[id] = true
+	recent.next = (recent.next + 1) % duplicateWindow
+
+	logger.message(msg, "Received message")
 	return false
 }
 
@@ -93,58 +144,97 @@ func isDuplicate(timestamp string, timestampMap *map[reflect.Type]string, msg st
 // the correct channel based on the type it received.
 //
 // Received message format:
-// | uniqueID | TimeStamp | PID | Struct type | Message |
+// | uniqueID | TimeStamp | Sender | Struct type | Message |
+//
+// Messages from sender, see SenderID, are the receiver's own and are dropped.
 //
-// Note: the PID is of the sending process. It's used to filter out messages so
-// 	     they are not sent to the sending process.
-func Receiver(port int, outputChans ...interface{}) {
+// Receiver returns when ctx is cancelled, and closes conn. What's received is
+// logged to logger, which may be nil. A failed read is retried after a wait
+// that grows while the reads keep failing.
+func Receiver(ctx context.Context, conn net.PacketConn, logger *Logger, sender int,
+	outputChans ...interface{}) {
 	// the end position of the timestamp in the received message
 	const timestampLength = 20
-	const pidLength = 6
-	pid := os.Getpid()
 
-	// open connection
-	conn := conn.DialBroadcastUDP(port)
+	// create map for storing ids of the different types of received messages
+	recentMap := make(map[reflect.Type]*recentMessages)
 
-	// create map for storing timestamp of the different types of received messages
-	timestampMap := make(map[reflect.Type]string)
+	// closing the socket unblocks ReadFrom
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 
+	buf := make([]byte, maxMessageSize) // receive buffer
+	backoff := readBackoffMin
 	for {
-		var buf [1024]byte // receive buffer
-
-		conn.ReadFrom(buf[0:])           // read from network
+		n, _, err := conn.ReadFrom(buf) // read from network
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.errorf("Network RX - read failed: %v, retrying in %s\n", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > readBackoffMax {
+				backoff = readBackoffMax
+			}
+			continue
+		}
+		backoff = readBackoffMin
+		if n < len(uniqueID)+timestampLength+senderLength {
+			logger.errorf("Network RX - dropped message of %d bytes, too short\n", n)
+			continue
+		}
+		buf := buf[:n]
 		for _, ch := range outputChans { // check outputChans against the prefix to check which type of message was received
 			Type := reflect.TypeOf(ch).Elem() // Type of channel
 			typeName := Type.String()
 
 			prefix := uniqueID + typeName                                               // prefix to search for
 			nanoTimeStamp := string(buf[len(uniqueID) : timestampLength+len(uniqueID)]) // extract timestamp
-			pidStr := string(buf[timestampLength+len(uniqueID) : timestampLength+len(uniqueID)+pidLength])
-			recvPid, err := strconv.Atoi(pidStr)
+			senderStr := string(buf[timestampLength+len(uniqueID) : timestampLength+len(uniqueID)+senderLength])
+			recvSender, err := strconv.Atoi(senderStr)
 			if err != nil {
-				logger.Printf("Received pid string '%s' couldn't be converted\n", pidStr)
-			} else if recvPid == pid {
+				logger.errorf("Received sender string '%s' couldn't be converted\n", senderStr)
+			} else if recvSender == sender {
 				break // do not receive your own messages
 			}
 
-			// remove the timestamp and pid from the message
-			msg := string(buf[:len(uniqueID)]) + string(buf[len(uniqueID)+timestampLength+pidLength:])
+			// remove the timestamp and sender from the message
+			msg := string(buf[:len(uniqueID)]) + string(buf[len(uniqueID)+timestampLength+senderLength:])
 			terminatedMsg := msg[:clen([]byte(msg))] // remove trailing zero bytes
 
 			if strings.HasPrefix(terminatedMsg[:clen([]byte(msg))], prefix) {
-				if isDuplicate(nanoTimeStamp, &timestampMap, terminatedMsg, Type) {
+				if isDuplicate(logger, nanoTimeStamp+senderStr, recentMap, terminatedMsg, Type) {
 					break // if message is duplicate, don't decode the message
 				}
 
 				// convert from json to correct struct type
 				v := reflect.New(Type)
-				json.Unmarshal([]byte(terminatedMsg[len(prefix):clen([]byte(msg))]), v.Interface())
+				data := []byte(terminatedMsg[len(prefix):clen([]byte(msg))])
+				if err := json.Unmarshal(data, v.Interface()); err != nil {
+					logger.errorf("Network RX - could not decode %s of %d bytes: %v\n",
+						typeName, n, err)
+					break
+				}
 
-				reflect.Select([]reflect.SelectCase{{
+				chosen, _, _ := reflect.Select([]reflect.SelectCase{{
 					Dir:  reflect.SelectSend,
 					Chan: reflect.ValueOf(ch),
 					Send: reflect.Indirect(v),
+				}, {
+					Dir:  reflect.SelectRecv,
+					Chan: reflect.ValueOf(ctx.Done()),
 				}})
+				if chosen == 1 {
+					return
+				}
 			}
 		}
 	}
@@ -152,47 +242,72 @@ func Receiver(port int, outputChans ...interface{}) {
 
 // Takes in a struct and adds a uniqueID and the type of the struct as a prefix.
 // Used before transmitting a message over the network
-func convertToJSONMsg(msg interface{}) string {
+func convertToJSONMsg(logger *Logger, msg interface{}) string {
 
 	json, err := json.Marshal(msg)
 
 	if err != nil {
-		logger.Println("Network TX - convertToJSONMsg:", err)
+		logger.errorf("Network TX - convertToJSONMsg: %v\n", err)
 	}
 
 	return reflect.TypeOf(msg).String() + string(json)
 }
 
-func prefixMsg(msg string) string {
+func prefixMsg(msg string, sender int) string {
 	nanoTime := fmt.Sprintf("%020d", time.Now().UTC().UnixNano())
-	pid := fmt.Sprintf("%06d", os.Getpid())
+	senderStr := fmt.Sprintf("%0*d", senderLength, sender%senderLimit)
 
-	prefixedMsg := uniqueID + nanoTime + pid + msg
+	prefixedMsg := uniqueID + nanoTime + senderStr + msg
 	return prefixedMsg
 }
 
 // Transmitter routine used to transmit message sent into txChan as a struct
-// Adds unique ID and typePrefix.
-func Transmitter(port int, txChan <-chan interface{}) {
-
-	conn := conn.DialBroadcastUDP(port)
-	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("255.255.255.255:%d", port))
+// Adds unique ID and typePrefix. conn must be opened with
+// conn.DialBroadcastUDP. Each message is sent according to its entry in
+// policies. Copies are queued, so txChan is always read promptly. Messages
+// are marked with sender, see SenderID. What's sent is logged to logger, which
+// may be nil. Transmitter returns when ctx is cancelled, and closes conn.
+func Transmitter(ctx context.Context, conn net.PacketConn, logger *Logger, port int,
+	sender int, txChan <-chan interface{}, policies Policies) {
+	addr := &net.UDPAddr{IP: net.IPv4bcast, Port: port}
+	defer conn.Close()
+
+	var queue sendQueue
+	timer := time.NewTimer(time.Hour) // this init time doesn't matter
+	timer.Stop()
 
 	for {
-		// wait for msg
+		// wait for msg or for the next copy to be due
 		select {
 		case msg := <-txChan:
-
 			// convert received struct to json with prefix
-			jsonMsg := convertToJSONMsg(msg)
-			logMessage(jsonMsg, "Sending message")
-			jsonMsg = prefixMsg(jsonMsg)
-
-			for i := 0; i < timesToResendMessage; i++ {
-				// transmit msg
-				conn.WriteTo([]byte(jsonMsg), addr)
-				// time.Sleep(1 * time.Millisecond)
+			jsonMsg := convertToJSONMsg(logger, msg)
+			logger.message(jsonMsg, "Sending message")
+			jsonMsg = prefixMsg(jsonMsg, sender)
+			if len(jsonMsg) > maxMessageSize {
+				logger.errorf("Network TX - dropped %T of %d bytes, larger than %d\n",
+					msg, len(jsonMsg), maxMessageSize)
+			} else if dropped := queue.schedule([]byte(jsonMsg), policies.lookup(msg), time.Now()); dropped > 0 {
+				logger.errorf("Network TX - queue full, dropped %d copies\n", dropped)
+			}
+
+		case <-timer.C:
+
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		// transmit all copies that are due
+		for _, data := range queue.popDue(time.Now()) {
+			if _, err := conn.WriteTo(data, addr); err != nil {
+				logger.errorf("Network TX - write failed: %v\n", err)
 			}
 		}
+
+		timer.Stop()
+		if d, ok := queue.next(time.Now()); ok {
+			timer.Reset(d)
+		}
 	}
 }
@@ -0,0 +1,102 @@
+package bcast
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMsg struct {
+	From string
+}
+
+// medium is an in-memory broadcast network, every packet written to one of
+// its conns is delivered to all of them.
+type medium struct {
+	mu    sync.Mutex
+	conns []*mediumConn
+}
+
+// mediumConn is a packet conn on a medium. Only the methods used by
+// Transmitter and Receiver are implemented.
+type mediumConn struct {
+	net.PacketConn
+	m      *medium
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (m *medium) conn() *mediumConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := &mediumConn{m: m, in: make(chan []byte, 64), closed: make(chan struct{})}
+	m.conns = append(m.conns, c)
+	return c
+}
+
+func (c *mediumConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case data := <-c.in:
+		return copy(b, data), nil, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *mediumConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	for _, other := range c.m.conns {
+		select {
+		case other.in <- append([]byte(nil), b...):
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (c *mediumConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// TestSender runs two elevators in one process on a medium. Each must hear
+// the other, but not itself.
+func TestSender(t *testing.T) {
+	if SenderID("a") == SenderID("b") {
+		t.Fatal("elevators a and b have the same sender id")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	policies := Policies{PolicyKey(testMsg{}): {Copies: 1}}
+
+	m := &medium{}
+	tx := make(map[string]chan interface{})
+	rx := make(map[string]chan testMsg)
+	for _, id := range []string{"a", "b"} {
+		tx[id] = make(chan interface{})
+		rx[id] = make(chan testMsg, 16)
+		go Transmitter(ctx, m.conn(), nil, 0, SenderID(id), tx[id], policies)
+		go Receiver(ctx, m.conn(), nil, SenderID(id), rx[id])
+	}
+
+	for _, tt := range []struct{ from, to string }{{"a", "b"}, {"b", "a"}} {
+		tx[tt.from] <- testMsg{From: tt.from}
+		select {
+		case msg := <-rx[tt.to]:
+			if msg.From != tt.from {
+				t.Errorf("%s received a message from %s, want from %s", tt.to, msg.From, tt.from)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message from %s didn't reach %s", tt.from, tt.to)
+		}
+		select {
+		case msg := <-rx[tt.from]:
+			t.Errorf("%s received its own message %v", tt.from, msg)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package bcast
+
+import (
+	"container/heap"
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+const (
+	// Max number of copies waiting to be sent. Further copies are dropped,
+	// but the first copy of a message is always sent.
+	maxQueuedCopies int = 1000
+)
+
+// Policy says how a type of message is sent. The first copy is sent right
+// away and the rest are spread Spacing apart, each moved randomly by up to
+// Jitter, so that a burst of packet loss doesn't drop all of them.
+type Policy struct {
+	Copies  int
+	Spacing time.Duration
+	Jitter  time.Duration
+}
+
+// Policies maps the type name of a message, see PolicyKey, to its Policy.
+// Types not in the map use DefaultPolicy.
+type Policies map[string]Policy
+
+// DefaultPolicy is used for messages without a policy of their own.
+var DefaultPolicy = Policy{
+	Copies:  timesToResendMessage,
+	Spacing: 10 * time.Millisecond,
+	Jitter:  4 * time.Millisecond,
+}
+
+// PolicyKey returns the key used for msg's type in Policies.
+func PolicyKey(msg interface{}) string {
+	return reflect.TypeOf(msg).String()
+}
+
+// lookup returns the policy for msg.
+func (p Policies) lookup(msg interface{}) Policy {
+	if pol, ok := p[PolicyKey(msg)]; ok {
+		return pol
+	}
+	return DefaultPolicy
+}
+
+// copyToSend is one scheduled transmission of a message.
+type copyToSend struct {
+	due  time.Time
+	data []byte
+}
+
+// sendQueue is a min-heap of copies ordered by when they're due.
+type sendQueue []copyToSend
+
+func (q sendQueue) Len() int            { return len(q) }
+func (q sendQueue) Less(i, j int) bool  { return q[i].due.Before(q[j].due) }
+func (q sendQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *sendQueue) Push(x interface{}) { *q = append(*q, x.(copyToSend)) }
+func (q *sendQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// schedule queues the copies of data according to pol, starting at now.
+// Returns the number of copies that were dropped because the queue is full.
+func (q *sendQueue) schedule(data []byte, pol Policy, now time.Time) int {
+	dropped := 0
+	for i := 0; i < pol.Copies; i++ {
+		due := now
+		if i > 0 {
+			if q.Len() >= maxQueuedCopies {
+				dropped++
+				continue
+			}
+			due = due.Add(time.Duration(i) * pol.Spacing)
+			if pol.Jitter > 0 {
+				due = due.Add(time.Duration(rand.Int63n(int64(2*pol.Jitter))) - pol.Jitter)
+			}
+			if due.Before(now) {
+				due = now
+			}
+		}
+		heap.Push(q, copyToSend{due: due, data: data})
+	}
+	return dropped
+}
+
+// popDue removes and returns all copies due at or before now.
+func (q *sendQueue) popDue(now time.Time) [][]byte {
+	var due [][]byte
+	for q.Len() > 0 && !(*q)[0].due.After(now) {
+		due = append(due, heap.Pop(q).(copyToSend).data)
+	}
+	return due
+}
+
+// next returns how long until the next copy is due.
+func (q *sendQueue) next(now time.Time) (time.Duration, bool) {
+	if q.Len() == 0 {
+		return 0, false
+	}
+	return (*q)[0].due.Sub(now), true
+}
@@ -0,0 +1,107 @@
+package bcast
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1000, 0)
+
+// dues returns when the queued copies of data are due, in order.
+func (q sendQueue) dues(data string) []time.Time {
+	var dues []time.Time
+	for _, c := range q {
+		if string(c.data) == data {
+			dues = append(dues, c.due)
+		}
+	}
+	sort.Slice(dues, func(i, j int) bool { return dues[i].Before(dues[j]) })
+	return dues
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	var q sendQueue
+	// a at 0, 30 and 60 ms, b at 5 and 25 ms
+	q.schedule([]byte("a"), Policy{Copies: 3, Spacing: 30 * time.Millisecond}, now)
+	q.schedule([]byte("b"), Policy{Copies: 2, Spacing: 20 * time.Millisecond},
+		now.Add(5*time.Millisecond))
+
+	popped := func(at time.Duration) string {
+		var s string
+		for _, data := range q.popDue(now.Add(at)) {
+			s += string(data)
+		}
+		return s
+	}
+	if got := popped(26 * time.Millisecond); got != "abb" {
+		t.Errorf("sent '%s' at 26ms, want 'abb'", got)
+	}
+	if d, ok := q.next(now.Add(26 * time.Millisecond)); !ok || d != 4*time.Millisecond {
+		t.Errorf("next copy due in %s (%v), want 4ms", d, ok)
+	}
+	if got := popped(100 * time.Millisecond); got != "aa" {
+		t.Errorf("sent '%s' at 100ms, want 'aa'", got)
+	}
+	if _, ok := q.next(now); ok {
+		t.Error("copies left after sending everything")
+	}
+}
+
+func TestSendQueueSpacing(t *testing.T) {
+	pol := Policy{Copies: 10, Spacing: 10 * time.Millisecond, Jitter: 4 * time.Millisecond}
+	// the jitter is random, so try it a number of times
+	for run := 0; run < 100; run++ {
+		var q sendQueue
+		q.schedule([]byte("m"), pol, now)
+		dues := q.dues("m")
+		if len(dues) != pol.Copies {
+			t.Fatalf("%d copies queued, want %d", len(dues), pol.Copies)
+		}
+		if !dues[0].Equal(now) {
+			t.Errorf("first copy due at %s, want right away", dues[0].Sub(now))
+		}
+		for i := 1; i < len(dues); i++ {
+			at := dues[i].Sub(now)
+			spaced := time.Duration(i) * pol.Spacing
+			if at < spaced-pol.Jitter || at >= spaced+pol.Jitter {
+				t.Errorf("copy %d due at %s, want %s ± %s", i, at, spaced, pol.Jitter)
+			}
+		}
+	}
+
+	// jitter larger than the spacing never makes a copy due before the first
+	var q sendQueue
+	q.schedule([]byte("m"), Policy{Copies: 10, Spacing: time.Millisecond,
+		Jitter: 4 * time.Millisecond}, now)
+	for _, due := range q.dues("m") {
+		if due.Before(now) {
+			t.Errorf("copy due %s before it was scheduled", now.Sub(due))
+		}
+	}
+}
+
+func TestSendQueueCap(t *testing.T) {
+	var q sendQueue
+	pol := Policy{Copies: maxQueuedCopies + 5, Spacing: time.Millisecond}
+	if dropped := q.schedule([]byte("a"), pol, now); dropped != 5 {
+		t.Errorf("dropped %d copies of a, want 5", dropped)
+	}
+	if q.Len() != maxQueuedCopies {
+		t.Errorf("%d copies queued, want the cap of %d", q.Len(), maxQueuedCopies)
+	}
+
+	// the first copy is queued past the cap
+	pol = Policy{Copies: 3, Spacing: time.Millisecond}
+	if dropped := q.schedule([]byte("b"), pol, now); dropped != 2 {
+		t.Errorf("dropped %d copies of b, want 2", dropped)
+	}
+	// both are due at the same time, in no particular order
+	sent := make(map[string]int)
+	for _, data := range q.popDue(now) {
+		sent[string(data)]++
+	}
+	if len(sent) != 2 || sent["a"] != 1 || sent["b"] != 1 {
+		t.Errorf("sent %v right away, want the first copies of a and b", sent)
+	}
+}
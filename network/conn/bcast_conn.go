@@ -3,20 +3,38 @@
 package conn
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"syscall"
 )
 
-func DialBroadcastUDP(port int) net.PacketConn {
-	s, _ := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
-	syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-	syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
-	syscall.Bind(s, &syscall.SockaddrInet4{Port: port})
+// DialBroadcastUDP opens a UDP socket bound to port with SO_REUSEADDR and
+// SO_BROADCAST set. The socket is closed again if any step fails.
+func DialBroadcastUDP(port int) (net.PacketConn, error) {
+	s, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("setsockopt SO_REUSEADDR", err)
+	}
+	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("setsockopt SO_BROADCAST", err)
+	}
+	if err := syscall.Bind(s, &syscall.SockaddrInet4{Port: port}); err != nil {
+		syscall.Close(s)
+		return nil, fmt.Errorf("bind to port %d: %w", port, os.NewSyscallError("bind", err))
+	}
 
 	f := os.NewFile(uintptr(s), "")
-	conn, _ := net.FilePacketConn(f)
+	conn, err := net.FilePacketConn(f)
 	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("file packet conn: %w", err)
+	}
 
-	return conn
+	return conn, nil
 }
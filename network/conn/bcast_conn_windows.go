@@ -44,19 +44,18 @@ SOCKET cBcastSocket(u_short port){
     SOCKET s;
 
     if((s = socket(AF_INET , SOCK_DGRAM , 0 )) == INVALID_SOCKET){
-        printf("Could not create socket: %d\n" , WSAGetLastError());
-        exit(EXIT_FAILURE);
+        return INVALID_SOCKET;
     }
 
     int opt = 1;
     int optlen = sizeof(opt);
     if(setsockopt(s, SOL_SOCKET, SO_BROADCAST, (char*)&opt, optlen) == SOCKET_ERROR){
-        printf("SO_BROADCAST failed with error code : %d\n" , WSAGetLastError());
-        exit(EXIT_FAILURE);
+        closesocket(s);
+        return INVALID_SOCKET;
     }
     if(setsockopt(s, SOL_SOCKET, SO_REUSEADDR, (char*)&opt, optlen) == SOCKET_ERROR){
-        printf("SO_REUSEADDR failed with error code : %d\n" , WSAGetLastError());
-        exit(EXIT_FAILURE);
+        closesocket(s);
+        return INVALID_SOCKET;
     }
 
     struct sockaddr_in a;
@@ -65,8 +64,8 @@ SOCKET cBcastSocket(u_short port){
     a.sin_port = htons(port);
 
     if(bind(s, (struct sockaddr*)&a, sizeof(a)) == SOCKET_ERROR){
-        printf("Bind failed with error code : %d\n" , WSAGetLastError());
-        exit(EXIT_FAILURE);
+        closesocket(s);
+        return INVALID_SOCKET;
     }
 
     return s;
@@ -111,6 +110,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"syscall"
 	"time"
 	"unsafe"
 )
@@ -194,6 +194,13 @@ func (f WindowsBroadcastConn) SetWriteDeadline(t time.Time) error {
 	}
 }
 
-func DialBroadcastUDP(port int) net.PacketConn {
-	return WindowsBroadcastConn{C.cBcastSocket(C.u_short(port))}
+// DialBroadcastUDP opens a UDP socket bound to port with SO_REUSEADDR and
+// SO_BROADCAST set.
+func DialBroadcastUDP(port int) (net.PacketConn, error) {
+	s := C.cBcastSocket(C.u_short(port))
+	if s == C.INVALID_SOCKET {
+		return nil, fmt.Errorf("creating broadcast socket on port %d failed with error code %d: %w",
+			port, C.WSAGetLastError(), syscall.Errno(C.WSAGetLastError()))
+	}
+	return WindowsBroadcastConn{s}, nil
 }
@@ -0,0 +1,40 @@
+package conn
+
+import (
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// isTransient reports whether err is an error opening a socket that may go
+// away by itself, like running out of buffers. EADDRINUSE isn't retried: the
+// socket is bound with SO_REUSEADDR, so it's only returned when the port is
+// held by a program that doesn't set it, which won't release it soon.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ENOBUFS)
+}
+
+// DialBroadcastUDPRetry calls DialBroadcastUDP up to attempts times, waiting
+// interval between each try. Only transient errors are retried, any other
+// error is returned immediately.
+func DialBroadcastUDPRetry(port, attempts int, interval time.Duration) (net.PacketConn, error) {
+	var err error
+	for i := 1; i <= attempts; i++ {
+		var c net.PacketConn
+		c, err = DialBroadcastUDP(port)
+		if err == nil {
+			return c, nil
+		}
+		if !isTransient(err) || i == attempts {
+			break
+		}
+		log.Printf("Opening broadcast socket on port %d failed (attempt %d/%d): %v. "+
+			"Retrying in %s.\n", port, i, attempts, err, interval)
+		time.Sleep(interval)
+	}
+	return nil, err
+}
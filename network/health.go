@@ -0,0 +1,51 @@
+package network
+
+import (
+	"net"
+	"time"
+
+	"../health"
+)
+
+const (
+	// Names the receiver and transmitter report progress under, see the
+	// health package. They're given to health.Name with UDP.ID.
+	RxHealthName string = "network rx"
+	TxHealthName string = "network tx"
+
+	// How long the receiver waits for a message before reporting that it's
+	// still alive.
+	rxPollInterval time.Duration = 500 * time.Millisecond
+	// The receiver reports at least every rxPollInterval. The transmitter
+	// only reports when it sends, so the caller must send something, e.g. a
+	// heartbeat, more often than this.
+	healthTimeout time.Duration = 2 * time.Second
+)
+
+// monitoredConn reports progress to the health registry every time a read or
+// write returns, also when it fails, since a failed write on a disconnected
+// network doesn't mean the goroutine is stuck.
+type monitoredConn struct {
+	net.PacketConn
+	name string
+}
+
+// ReadFrom reads with a deadline so that an idle network isn't mistaken for a
+// stuck receiver. Timeouts are not returned to the caller.
+func (c monitoredConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.SetReadDeadline(time.Now().Add(rxPollInterval))
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		health.Beat(c.name)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func (c monitoredConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	health.Beat(c.name)
+	return n, err
+}
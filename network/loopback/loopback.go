@@ -0,0 +1,381 @@
+package loopback
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"../../group"
+	"../bcast"
+)
+
+const (
+	// How many packets can wait for a node's receiver before new ones are
+	// dropped, like a full socket buffer.
+	inboxSize int = 1024
+	// How many packet ids back to remember when filtering duplicates
+	duplicateWindow int = 64
+	// How long a reordered packet is held back at most. It's delivered then
+	// if no other packet to the node has come first, so the last packet
+	// before a quiet period isn't held forever.
+	maxHoldTime time.Duration = 50 * time.Millisecond
+)
+
+// packet is what travels between nodes. It carries the same information as
+// the prefix of a bcast message: sender, a message id and the struct type.
+type packet struct {
+	from     string
+	id       uint64
+	typeName string
+	data     []byte
+}
+
+// recentIDs remembers the ids of the last received packets of one type.
+type recentIDs struct {
+	ids  map[uint64]bool
+	ring [duplicateWindow]uint64
+	next int
+}
+
+// add remembers id and returns false if it was already remembered.
+func (r *recentIDs) add(id uint64) bool {
+	if r.ids[id] {
+		return false
+	}
+	delete(r.ids, r.ring[r.next])
+	r.ring[r.next] = id
+	r.ids[id] = true
+	r.next = (r.next + 1) % duplicateWindow
+	return true
+}
+
+// Stats counts what happened to the packets sent through a Hub.
+type Stats struct {
+	Sent        int
+	Delivered   int
+	Lost        int
+	Duplicated  int
+	Reordered   int
+	Partitioned int
+	Overflowed  int
+}
+
+// Hub connects any number of simulated nodes in the same process. Everything a
+// node transmits is broadcast to every other node, subject to the faults
+// programmed on the hub. Random faults are drawn from a seeded source so a run
+// can be repeated.
+type Hub struct {
+	mu    sync.Mutex
+	rng   *rand.Rand
+	nodes map[string]*Node
+	order []string // node ids in the order they were added
+	seq   uint64
+	stats Stats
+
+	loss      float64
+	duplicate float64
+	reorder   float64
+	delay     time.Duration
+	jitter    time.Duration
+
+	// group of each node while partitioned, nil when the network is whole
+	groups map[string]int
+}
+
+// Node is one simulated network interface. Its Transmitter and Receiver have
+// the same contract as bcast.Transmitter and bcast.Receiver.
+type Node struct {
+	hub   *Hub
+	id    string
+	inbox chan packet
+	held  *packet // packet held back to be delivered after the next one
+	// delivers held if no other packet comes within maxHoldTime
+	holdTimer *time.Timer
+}
+
+// NewHub creates a hub with a perfect network. seed is used for all random
+// faults.
+func NewHub(seed int64) *Hub {
+	return &Hub{
+		rng:   rand.New(rand.NewSource(seed)),
+		nodes: make(map[string]*Node),
+	}
+}
+
+// Node returns the node with the given id, creating it if it doesn't exist.
+func (h *Hub) Node(id string) *Node {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n, ok := h.nodes[id]; ok {
+		return n
+	}
+	n := &Node{hub: h, id: id, inbox: make(chan packet, inboxSize)}
+	h.nodes[id] = n
+	h.order = append(h.order, id)
+	return n
+}
+
+// SetLoss sets the probability that a packet is lost on the way to a node.
+func (h *Hub) SetLoss(p float64) {
+	h.mu.Lock()
+	h.loss = p
+	h.mu.Unlock()
+}
+
+// SetDuplication sets the probability that a packet arrives twice.
+func (h *Hub) SetDuplication(p float64) {
+	h.mu.Lock()
+	h.duplicate = p
+	h.mu.Unlock()
+}
+
+// SetReordering sets the probability that a packet is held back and arrives
+// after the next packet to the same node, or after maxHoldTime if no other
+// packet comes.
+func (h *Hub) SetReordering(p float64) {
+	h.mu.Lock()
+	h.reorder = p
+	h.mu.Unlock()
+}
+
+// SetDelay makes every packet arrive after base plus a random duration up to
+// jitter. With zero delay packets are delivered before the send returns.
+func (h *Hub) SetDelay(base, jitter time.Duration) {
+	h.mu.Lock()
+	h.delay = base
+	h.jitter = jitter
+	h.mu.Unlock()
+}
+
+// Partition splits the network so that nodes can only reach nodes in the same
+// group. Nodes not listed in any group end up alone.
+func (h *Hub) Partition(groups ...[]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, id := range g {
+			h.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (h *Hub) Heal() {
+	h.mu.Lock()
+	h.groups = nil
+	h.mu.Unlock()
+}
+
+// Stats returns a copy of the packet counters.
+func (h *Hub) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// reachable reports whether a packet from can get to to. Must be called with
+// h.mu held.
+func (h *Hub) reachable(from, to string) bool {
+	if h.groups == nil {
+		return true
+	}
+	return h.groups[from] != 0 && h.groups[from] == h.groups[to]
+}
+
+// roll returns true with probability p. Must be called with h.mu held.
+func (h *Hub) roll(p float64) bool {
+	return p > 0 && h.rng.Float64() < p
+}
+
+// broadcast sends p to every node except the sender.
+func (h *Hub) broadcast(p packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stats.Sent++
+	for _, id := range h.order {
+		n := h.nodes[id]
+		if id == p.from {
+			continue
+		}
+		if !h.reachable(p.from, id) {
+			h.stats.Partitioned++
+			continue
+		}
+		if h.roll(h.loss) {
+			h.stats.Lost++
+			continue
+		}
+
+		copies := 1
+		if h.roll(h.duplicate) {
+			h.stats.Duplicated++
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			if n.held == nil && h.roll(h.reorder) {
+				h.stats.Reordered++
+				h.hold(n, p)
+				continue
+			}
+			h.schedule(n, p)
+			h.release(n)
+		}
+	}
+}
+
+// hold holds p back from n until the next packet to n, or until maxHoldTime
+// has passed. Must be called with h.mu held.
+func (h *Hub) hold(n *Node, p packet) {
+	held := &p
+	n.held = held
+	n.holdTimer = time.AfterFunc(maxHoldTime, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if n.held == held {
+			h.release(n)
+		}
+	})
+}
+
+// release schedules the packet held back from n, if any. Must be called with
+// h.mu held.
+func (h *Hub) release(n *Node) {
+	if n.held == nil {
+		return
+	}
+	n.holdTimer.Stop()
+	h.schedule(n, *n.held)
+	n.held = nil
+}
+
+// schedule puts p in the inbox of n after the programmed delay. Must be
+// called with h.mu held.
+func (h *Hub) schedule(n *Node, p packet) {
+	d := h.delay
+	if h.jitter > 0 {
+		d += time.Duration(h.rng.Int63n(int64(h.jitter)))
+	}
+	if d <= 0 {
+		h.deliver(n, p)
+		return
+	}
+	time.AfterFunc(d, func() {
+		h.mu.Lock()
+		h.deliver(n, p)
+		h.mu.Unlock()
+	})
+}
+
+// deliver puts p in the inbox of n, or drops it if the inbox is full. Must be
+// called with h.mu held.
+func (h *Hub) deliver(n *Node, p packet) {
+	select {
+	case n.inbox <- p:
+		h.stats.Delivered++
+	default:
+		h.stats.Overflowed++
+	}
+}
+
+// Run runs the transmitter and receiver of the node until ctx is cancelled,
+// like network.UDP. The policies are ignored, since the hub decides what is
+// lost.
+func (n *Node) Run(ctx context.Context, policies bcast.Policies, txChan chan interface{},
+	rxChans ...interface{}) error {
+	g, ctx := group.WithContext(ctx)
+	g.Go("loopback transmitter "+n.id, func(ctx context.Context) error {
+		n.Transmitter(ctx, txChan)
+		return nil
+	})
+	g.Go("loopback receiver "+n.id, func(ctx context.Context) error {
+		n.Receiver(ctx, rxChans...)
+		return nil
+	})
+	return g.Wait()
+}
+
+// Transmitter reads structs from txChan and broadcasts them to the other
+// nodes until ctx is cancelled.
+func (n *Node) Transmitter(ctx context.Context, txChan <-chan interface{}) {
+	for {
+		var msg interface{}
+		select {
+		case msg = <-txChan:
+		case <-ctx.Done():
+			return
+		}
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Loopback %s TX - %v\n", n.id, err)
+			continue
+		}
+
+		n.hub.mu.Lock()
+		n.hub.seq++
+		id := n.hub.seq
+		n.hub.mu.Unlock()
+
+		n.hub.broadcast(packet{
+			from:     n.id,
+			id:       id,
+			typeName: reflect.TypeOf(msg).String(),
+			data:     data,
+		})
+	}
+}
+
+// Receiver decodes packets sent to this node and outputs them on the channel
+// with the matching element type. As in bcast, a packet with the same id as
+// one of the last received of its type is dropped as a duplicate. Receiver
+// returns when ctx is cancelled.
+func (n *Node) Receiver(ctx context.Context, outputChans ...interface{}) {
+	recent := make(map[reflect.Type]*recentIDs)
+
+	for {
+		var p packet
+		select {
+		case p = <-n.inbox:
+		case <-ctx.Done():
+			return
+		}
+		for _, ch := range outputChans {
+			Type := reflect.TypeOf(ch).Elem()
+			if Type.String() != p.typeName {
+				continue
+			}
+			if recent[Type] == nil {
+				recent[Type] = &recentIDs{ids: make(map[uint64]bool)}
+			}
+			if !recent[Type].add(p.id) {
+				break
+			}
+
+			v := reflect.New(Type)
+			if err := json.Unmarshal(p.data, v.Interface()); err != nil {
+				log.Printf("Loopback %s RX - %v\n", n.id, err)
+				break
+			}
+			chosen, _, _ := reflect.Select([]reflect.SelectCase{{
+				Dir:  reflect.SelectSend,
+				Chan: reflect.ValueOf(ch),
+				Send: reflect.Indirect(v),
+			}, {
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(ctx.Done()),
+			}})
+			if chosen == 1 {
+				return
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package loopback
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testMsg struct {
+	N int
+}
+
+// How long to wait for a packet that should arrive, and for one that
+// shouldn't.
+const (
+	arriveTimeout time.Duration = 1 * time.Second
+	quietTime     time.Duration = 150 * time.Millisecond
+)
+
+// testNode is a running node of a hub.
+type testNode struct {
+	tx chan interface{}
+	rx chan testMsg
+}
+
+// start runs a node for each of ids on hub until the test ends.
+func start(t *testing.T, hub *Hub, ids ...string) map[string]testNode {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	nodes := make(map[string]testNode)
+	for _, id := range ids {
+		n := testNode{tx: make(chan interface{}), rx: make(chan testMsg, 16)}
+		go hub.Node(id).Run(ctx, nil, n.tx, n.rx)
+		nodes[id] = n
+	}
+	return nodes
+}
+
+// send transmits a message for each of ns.
+func (n testNode) send(ns ...int) {
+	for _, v := range ns {
+		n.tx <- testMsg{N: v}
+	}
+}
+
+// expect fails the test unless the messages in want arrive, in that order.
+func (n testNode) expect(t *testing.T, want ...int) {
+	t.Helper()
+	for _, v := range want {
+		select {
+		case m := <-n.rx:
+			if m.N != v {
+				t.Fatalf("received %d, want %d", m.N, v)
+			}
+		case <-time.After(arriveTimeout):
+			t.Fatalf("%d didn't arrive", v)
+		}
+	}
+}
+
+// expectNothing fails the test if a message arrives within quietTime.
+func (n testNode) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case m := <-n.rx:
+		t.Fatalf("received %d, want nothing", m.N)
+	case <-time.After(quietTime):
+	}
+}
+
+func TestPerfectNetwork(t *testing.T) {
+	hub := NewHub(1)
+	nodes := start(t, hub, "a", "b", "c")
+	nodes["a"].send(1, 2, 3)
+	nodes["b"].expect(t, 1, 2, 3)
+	nodes["c"].expect(t, 1, 2, 3)
+	nodes["a"].expectNothing(t)
+}
+
+func TestLoss(t *testing.T) {
+	hub := NewHub(1)
+	hub.SetLoss(1)
+	nodes := start(t, hub, "a", "b")
+	nodes["a"].send(1, 2)
+	nodes["b"].expectNothing(t)
+	if s := hub.Stats(); s.Lost != 2 || s.Delivered != 0 {
+		t.Errorf("lost %d and delivered %d packets, want 2 and 0", s.Lost, s.Delivered)
+	}
+}
+
+func TestDuplication(t *testing.T) {
+	hub := NewHub(1)
+	hub.SetDuplication(1)
+	nodes := start(t, hub, "a", "b")
+	nodes["a"].send(1, 2)
+	// the receiver drops the second copy of each
+	nodes["b"].expect(t, 1, 2)
+	nodes["b"].expectNothing(t)
+	if s := hub.Stats(); s.Duplicated != 2 || s.Delivered != 4 {
+		t.Errorf("duplicated %d and delivered %d packets, want 2 and 4",
+			s.Duplicated, s.Delivered)
+	}
+}
+
+func TestReordering(t *testing.T) {
+	hub := NewHub(1)
+	hub.SetReordering(1)
+	nodes := start(t, hub, "a", "b")
+	// 1 is held back until 2 has been delivered
+	nodes["a"].send(1, 2)
+	nodes["b"].expect(t, 2, 1)
+
+	// 3 is held back, but no packet follows it
+	nodes["a"].send(3)
+	sent := time.Now()
+	nodes["b"].expect(t, 3)
+	if waited := time.Since(sent); waited > 10*maxHoldTime {
+		t.Errorf("held packet arrived after %s, want about %s", waited, maxHoldTime)
+	}
+	if s := hub.Stats(); s.Reordered != 2 || s.Delivered != 3 {
+		t.Errorf("reordered %d and delivered %d packets, want 2 and 3",
+			s.Reordered, s.Delivered)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	hub := NewHub(1)
+	hub.SetDelay(2*quietTime, 0)
+	nodes := start(t, hub, "a", "b")
+	nodes["a"].send(1)
+	nodes["b"].expectNothing(t)
+	nodes["b"].expect(t, 1)
+}
+
+func TestPartition(t *testing.T) {
+	hub := NewHub(1)
+	nodes := start(t, hub, "a", "b", "c")
+	hub.Partition([]string{"a", "b"})
+	nodes["a"].send(1)
+	nodes["b"].expect(t, 1)
+	nodes["c"].expectNothing(t)
+
+	hub.Heal()
+	nodes["c"].send(2)
+	nodes["a"].expect(t, 2)
+	nodes["b"].expect(t, 2)
+	if s := hub.Stats(); s.Partitioned != 1 {
+		t.Errorf("%d packets stopped by the partition, want 1", s.Partitioned)
+	}
+}
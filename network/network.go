@@ -1,14 +1,78 @@
 package network
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"../group"
+	"../health"
 	"./bcast"
+	"./conn"
+)
+
+const (
+	// How many times to try opening a socket before giving up.
+	dialAttempts int = 5
+	// How long to wait between each attempt.
+	dialRetryInterval time.Duration = 1 * time.Second
 )
 
-// Network starts the transmitter and receiver threads used for sending and
-// receiving orders.
-func Network(port int, logID string, txChan chan interface{}, rxChans ...interface{}) {
-	bcast.InitLogger(logID)
+// Network runs the transmitter and receiver threads used for sending and
+// receiving orders until ctx is cancelled. Messages are sent according to
+// policies, see bcast.Policies, and logged to a file named by logID. The
+// receiver and transmitter are registered in the health registry for the
+// elevator id, see RxHealthName and TxHealthName. Messages are filtered by
+// id, see bcast.SenderID, so elevators in one process hear each other. An error is returned if the
+// sockets can't be opened.
+func Network(ctx context.Context, port int, id, logID string, policies bcast.Policies,
+	txChan chan interface{}, rxChans ...interface{}) error {
+	logger := bcast.NewLogger(logID)
+	defer logger.Close()
+
+	txConn, err := conn.DialBroadcastUDPRetry(port, dialAttempts, dialRetryInterval)
+	if err != nil {
+		return fmt.Errorf("network transmitter on port %d: %w", port, err)
+	}
+	rxConn, err := conn.DialBroadcastUDPRetry(port, dialAttempts, dialRetryInterval)
+	if err != nil {
+		txConn.Close()
+		return fmt.Errorf("network receiver on port %d: %w", port, err)
+	}
+	log.Printf("Network up on port %d\n", port)
+
+	txName, rxName := health.Name(id, TxHealthName), health.Name(id, RxHealthName)
+	health.Register(txName, healthTimeout)
+	defer health.Unregister(txName)
+	health.Register(rxName, healthTimeout)
+	defer health.Unregister(rxName)
+	sender := bcast.SenderID(id)
+	g, ctx := group.WithContext(ctx)
+	g.Go("network transmitter", func(ctx context.Context) error {
+		bcast.Transmitter(ctx, monitoredConn{txConn, txName}, logger, port, sender, txChan, policies)
+		return nil
+	})
+	g.Go("network receiver", func(ctx context.Context) error {
+		bcast.Receiver(ctx, monitoredConn{rxConn, rxName}, logger, sender, rxChans...)
+		return nil
+	})
+	err = g.Wait()
+	log.Printf("Network on port %d down\n", port)
+	return err
+}
+
+// UDP is the broadcast network on Port, run by Network. ID is the elevator
+// it's registered in the health registry for, and LogID names the network log
+// file.
+type UDP struct {
+	Port  int
+	ID    string
+	LogID string
+}
 
-	go bcast.Transmitter(port, txChan)
-	go bcast.Receiver(port, rxChans...)
+// Run runs the transmitter and receiver until ctx is cancelled, see Network.
+func (u UDP) Run(ctx context.Context, policies bcast.Policies, txChan chan interface{},
+	rxChans ...interface{}) error {
+	return Network(ctx, u.Port, u.ID, u.LogID, policies, txChan, rxChans...)
 }
@@ -0,0 +1,81 @@
+package peers
+
+import (
+	"sort"
+	"time"
+)
+
+// Heartbeat is broadcast periodically by every elevator to tell the others
+// it's still reachable.
+type Heartbeat struct {
+	ID string
+}
+
+// Update describes a change in which peers are reachable.
+type Update struct {
+	// Peers is all reachable peers, sorted by ID.
+	Peers []string
+	// New is the ID of a peer that just became reachable, or empty.
+	New string
+	// Lost is the IDs of peers that just became unreachable.
+	Lost []string
+}
+
+// Tracker keeps track of which peers are reachable, based on when a heartbeat
+// was last received from them.
+type Tracker struct {
+	self     string
+	timeout  time.Duration
+	lastSeen map[string]time.Time
+}
+
+// NewTracker creates a tracker for the peer with ID self. A peer is lost if
+// no heartbeat is received from it within timeout.
+func NewTracker(self string, timeout time.Duration) *Tracker {
+	return &Tracker{
+		self:     self,
+		timeout:  timeout,
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// Peers returns the IDs of all reachable peers, sorted.
+func (t *Tracker) Peers() []string {
+	ids := make([]string, 0, len(t.lastSeen))
+	for id := range t.lastSeen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Seen registers a heartbeat from id at time now. The returned bool is true
+// if id is a new peer.
+func (t *Tracker) Seen(id string, now time.Time) (Update, bool) {
+	if id == t.self {
+		return Update{}, false
+	}
+	_, known := t.lastSeen[id]
+	t.lastSeen[id] = now
+	if known {
+		return Update{}, false
+	}
+	return Update{Peers: t.Peers(), New: id}, true
+}
+
+// Expire removes peers which haven't been seen since now minus the timeout.
+// The returned bool is true if any peer was lost.
+func (t *Tracker) Expire(now time.Time) (Update, bool) {
+	var lost []string
+	for id, seen := range t.lastSeen {
+		if now.Sub(seen) > t.timeout {
+			lost = append(lost, id)
+			delete(t.lastSeen, id)
+		}
+	}
+	if len(lost) == 0 {
+		return Update{}, false
+	}
+	sort.Strings(lost)
+	return Update{Peers: t.Peers(), Lost: lost}, true
+}
@@ -0,0 +1,163 @@
+package txqueue
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Policy says what to do with a message when it's pushed.
+type Policy int
+
+const (
+	// DropOldest queues the message, dropping the oldest queued message if
+	// the queue is full.
+	DropOldest Policy = 0
+	// DropNewest drops the message if the queue is full.
+	DropNewest Policy = 1
+	// Coalesce replaces a queued message with the same key, so only the
+	// latest one is sent. If there's none it's queued as with DropOldest.
+	Coalesce Policy = 2
+)
+
+// Rule is the policy for one type of message. Key is used with Coalesce to
+// find which queued message to replace. If Key is nil all messages of the type
+// share one key.
+type Rule struct {
+	Policy Policy
+	Key    func(msg interface{}) string
+}
+
+// Rules maps the type name of a message, as given by reflect, to its Rule.
+// Types not in the map use DropOldest.
+type Rules map[string]Rule
+
+// Metrics is a snapshot of the queue counters.
+type Metrics struct {
+	Depth     int
+	MaxDepth  int
+	Capacity  int
+	Pushed    int
+	Sent      int
+	Dropped   int
+	Coalesced int
+}
+
+// ToString creates a string representation of the metrics.
+func (m Metrics) ToString() string {
+	return fmt.Sprintf("TxQueue:{depth:%d/%d max:%d pushed:%d sent:%d dropped:%d coalesced:%d}",
+		m.Depth, m.Capacity, m.MaxDepth, m.Pushed, m.Sent, m.Dropped, m.Coalesced)
+}
+
+type item struct {
+	key string
+	msg interface{}
+}
+
+// Queue is a bounded transmit queue. Push never blocks, and Run moves the
+// messages on to a transmitter at the pace the transmitter can take them.
+type Queue struct {
+	mu      sync.Mutex
+	items   []item
+	rules   Rules
+	metrics Metrics
+	ready   chan struct{}
+}
+
+// New creates a queue that holds at most capacity messages.
+func New(capacity int, rules Rules) *Queue {
+	return &Queue{
+		rules:   rules,
+		metrics: Metrics{Capacity: capacity},
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Push queues msg according to its rule. It never blocks.
+func (q *Queue) Push(msg interface{}) {
+	typeName := reflect.TypeOf(msg).String()
+	rule := q.rules[typeName]
+	key := typeName
+	if rule.Key != nil {
+		key += ":" + rule.Key(msg)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.metrics.Pushed++
+
+	if rule.Policy == Coalesce {
+		for i := range q.items {
+			if q.items[i].key == key {
+				q.items[i].msg = msg
+				q.metrics.Coalesced++
+				return
+			}
+		}
+	}
+
+	if len(q.items) >= q.metrics.Capacity {
+		q.metrics.Dropped++
+		if rule.Policy == DropNewest {
+			return
+		}
+		q.items = q.items[1:]
+	}
+	q.items = append(q.items, item{key: key, msg: msg})
+
+	q.metrics.Depth = len(q.items)
+	if q.metrics.Depth > q.metrics.MaxDepth {
+		q.metrics.MaxDepth = q.metrics.Depth
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes and returns the oldest message.
+func (q *Queue) pop() (interface{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	msg := q.items[0].msg
+	q.items = q.items[1:]
+	q.metrics.Depth = len(q.items)
+	q.metrics.Sent++
+	return msg, true
+}
+
+// Run sends queued messages on txChan until ctx is cancelled. It's meant to be
+// run as a goroutine.
+func (q *Queue) Run(ctx context.Context, txChan chan<- interface{}) {
+	for {
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			msg, ok := q.pop()
+			if !ok {
+				break
+			}
+			select {
+			case txChan <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Metrics returns a snapshot of the queue counters.
+func (q *Queue) Metrics() Metrics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.metrics
+}
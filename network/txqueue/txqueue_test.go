@@ -0,0 +1,104 @@
+package txqueue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type numbered struct {
+	N int
+}
+
+type keyed struct {
+	Key string
+	N   int
+}
+
+// drain pops every queued message, like Run.
+func drain(q *Queue) []interface{} {
+	var msgs []interface{}
+	for {
+		msg, ok := q.pop()
+		if !ok {
+			return msgs
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	keyRules := Rules{reflect.TypeOf(keyed{}).String(): {
+		Policy: Coalesce,
+		Key:    func(msg interface{}) string { return msg.(keyed).Key },
+	}}
+	tests := []struct {
+		name   string
+		rules  Rules
+		pushed []interface{}
+		want   []interface{}
+		// the counters after draining, Depth is always 0 and Capacity 3
+		metrics Metrics
+	}{
+		{"DropOldest", nil,
+			[]interface{}{numbered{1}, numbered{2}, numbered{3}, numbered{4}, numbered{5}},
+			[]interface{}{numbered{3}, numbered{4}, numbered{5}},
+			Metrics{MaxDepth: 3, Pushed: 5, Sent: 3, Dropped: 2}},
+		{"DropNewest", Rules{reflect.TypeOf(numbered{}).String(): {Policy: DropNewest}},
+			[]interface{}{numbered{1}, numbered{2}, numbered{3}, numbered{4}, numbered{5}},
+			[]interface{}{numbered{1}, numbered{2}, numbered{3}},
+			Metrics{MaxDepth: 3, Pushed: 5, Sent: 3, Dropped: 2}},
+		// x is replaced in its place, w pushes x out when the queue is full,
+		// and y is replaced without dropping anything
+		{"Coalesce", keyRules,
+			[]interface{}{keyed{"x", 1}, keyed{"y", 2}, keyed{"x", 3}, keyed{"z", 4},
+				keyed{"w", 5}, keyed{"y", 6}},
+			[]interface{}{keyed{"y", 6}, keyed{"z", 4}, keyed{"w", 5}},
+			Metrics{MaxDepth: 3, Pushed: 6, Sent: 3, Dropped: 1, Coalesced: 2}},
+		{"Coalesce without a key", Rules{reflect.TypeOf(numbered{}).String(): {Policy: Coalesce}},
+			[]interface{}{numbered{1}, numbered{2}, numbered{3}, numbered{4}, numbered{5}},
+			[]interface{}{numbered{5}},
+			Metrics{MaxDepth: 1, Pushed: 5, Sent: 1, Coalesced: 4}},
+	}
+
+	for _, tt := range tests {
+		q := New(3, tt.rules)
+		for _, msg := range tt.pushed {
+			q.Push(msg)
+		}
+		if got := drain(q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sent %v, want %v", tt.name, got, tt.want)
+		}
+		want := tt.metrics
+		want.Capacity = 3
+		if got := q.Metrics(); got != want {
+			t.Errorf("%s: %s, want %s", tt.name, got.ToString(), want.ToString())
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	q := New(3, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	txChan := make(chan interface{})
+	go q.Run(ctx, txChan)
+
+	for n := 1; n <= 3; n++ {
+		q.Push(numbered{n})
+	}
+	for n := 1; n <= 3; n++ {
+		select {
+		case msg := <-txChan:
+			if msg != (numbered{n}) {
+				t.Fatalf("sent %v, want %v", msg, numbered{n})
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v wasn't sent", numbered{n})
+		}
+	}
+	if m := q.Metrics(); m.Sent != 3 || m.Depth != 0 {
+		t.Errorf("%s after sending everything, want 3 sent and nothing queued", m.ToString())
+	}
+}
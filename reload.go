@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"./config"
+	"./control"
+	"./logging"
+)
+
+// How often the config file is checked for changes.
+const configPollInterval time.Duration = 1 * time.Second
+
+// modTime returns when the file at path was last changed, or the zero time if
+// it can't be read.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// watchConfig reloads the configuration on SIGHUP, or when the config file at
+// path changes, until ctx is cancelled. cfg is the configuration in use, and
+// flags the flags given at startup. See reloadConfig.
+func watchConfig(ctx context.Context, c *control.Controller, cfg config.Config,
+	path string, flags flagValues) error {
+	// SIGHUP would otherwise kill the process, so it's caught even without a
+	// config file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	lastMod := modTime(path)
+
+	for {
+		select {
+		case <-hup:
+			if path == "" {
+				log.Println("Received SIGHUP, but there's no config file to reload.")
+				continue
+			}
+			log.Printf("Received SIGHUP, reloading %s\n", path)
+
+		case <-ticker.C:
+			if path == "" {
+				continue
+			}
+			mod := modTime(path)
+			if mod.IsZero() || mod.Equal(lastMod) {
+				// an editor may remove the file while saving it
+				continue
+			}
+			lastMod = mod
+			log.Printf("%s has changed, reloading it\n", path)
+
+		case <-ctx.Done():
+			return nil
+		}
+		cfg = reloadConfig(ctx, c, cfg, path, flags)
+	}
+}
+
+// reloadConfig reads the config file at path, with flags on top like at
+// startup, and takes the settings that can be changed while running into use:
+// the driver timeouts, the order timeout and claim timing, and the log level.
+// Other changes are logged and ignored, and so are the settings in the file
+// that a flag overrides. A config file that can't be loaded is ignored as a
+// whole. Returns the configuration in use afterwards.
+func reloadConfig(ctx context.Context, c *control.Controller, cfg config.Config,
+	path string, flags flagValues) config.Config {
+	next, file, err := loadConfig(path, flags)
+	if err != nil {
+		log.Printf("Not reloading configuration: %v\n", err)
+		return cfg
+	}
+	for _, d := range file.Diff(next) {
+		if d.Reloadable() {
+			log.Printf("Ignoring %s %s in %s, it's set to %s by a flag\n",
+				d.Name, d.From, path, d.To)
+		}
+	}
+	next, changed, ignored := cfg.Reload(next)
+	for _, s := range ignored {
+		log.Printf("Ignoring change of %s, it needs a restart\n", s)
+	}
+	if len(changed) == 0 {
+		log.Println("Configuration reloaded, nothing to change.")
+		return cfg
+	}
+	for _, s := range changed {
+		log.Printf("Configuration changed: %s\n", s)
+	}
+
+	logging.SetLevel(next.Level())
+	if next.Settings() != cfg.Settings() {
+		if err := c.Reload(ctx, next.Settings()); err != nil {
+			return cfg
+		}
+	}
+	return next
+}
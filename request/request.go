@@ -5,7 +5,12 @@ import (
 	"../elevTypes/order"
 )
 
-var lastHallCall order.Order
+// Scheduler selects the next order for one elevator. The zero value is ready
+// to use.
+type Scheduler struct {
+	// the last hall order executed, which decides the preferred direction
+	lastHallCall order.Order
+}
 
 func orderBelow(elev elevator.Elevator) (int, order.Type, bool) {
 	for f := elev.Floor - 1; f >= 0; f-- {
@@ -20,7 +25,7 @@ func orderBelow(elev elevator.Elevator) (int, order.Type, bool) {
 }
 
 func orderAboveFromElev(elev elevator.Elevator) (int, order.Type, bool) {
-	for f := elev.Floor + 1; f < 4; f++ {
+	for f := elev.Floor + 1; f < elev.Nfloors; f++ {
 		for t := range elev.Orders[f] {
 			if elev.Orders[f][t].Status == order.NotTaken {
 				return f, order.Type(t), true
@@ -74,16 +79,23 @@ func orderBetween(elev elevator.Elevator) (int, order.Type, bool) {
 	return -1, -1, false
 }
 
+// noActiveOrder reports whether the elevator is free to start a new order,
+// either because the last one is finished or because it was released.
+func noActiveOrder(elev elevator.Elevator) bool {
+	return elev.ActiveOrder.Status == order.Finished ||
+		elev.ActiveOrder.Status == order.Invalid
+}
+
 // FindNextOrder evaluates all NotTaken orders and selects the best next order.
-func FindNextOrder(elev elevator.Elevator) order.Order {
+func (s *Scheduler) FindNextOrder(elev elevator.Elevator) order.Order {
 	if elev.ActiveOrder.Type == order.HallUp || elev.ActiveOrder.Type == order.HallDown {
-		lastHallCall = elev.ActiveOrder
+		s.lastHallCall = elev.ActiveOrder
 	}
 
 	var f int
 	var t order.Type
 	var ok bool = false
-	switch lastHallCall.Type {
+	switch s.lastHallCall.Type {
 	case order.HallUp:
 		if f, t, ok = orderAtFloor(elev); !ok || t == order.HallDown {
 			ok = false
@@ -103,7 +115,7 @@ func FindNextOrder(elev elevator.Elevator) order.Order {
 			f, t, ok = orderBelow(elev)
 		}
 
-		if elev.ActiveOrder.Status != order.Finished {
+		if !noActiveOrder(elev) {
 			ok = false
 		}
 
@@ -129,7 +141,7 @@ func FindNextOrder(elev elevator.Elevator) order.Order {
 			ok = false
 
 		}
-		if elev.ActiveOrder.Status != order.Finished {
+		if !noActiveOrder(elev) {
 			ok = false
 		}
 	}
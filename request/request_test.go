@@ -0,0 +1,22 @@
+package request
+
+import (
+	"testing"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+)
+
+func TestOrderAboveTopFloors(t *testing.T) {
+	// going up after a hall call, with the only order above floor 3
+	elev := elevator.NewElevator(6, 3)
+	elev.Floor = 2
+	elev.ActiveOrder = order.Order{Floor: 2, Type: order.HallUp, Status: order.Finished}
+	elev.Orders[5][order.HallDown].Status = order.NotTaken
+
+	var s Scheduler
+	got := s.FindNextOrder(elev)
+	if got.Status != order.Execute || got.Floor != 5 || got.Type != order.HallDown {
+		t.Errorf("next order is %s, want HallDown at floor 5", got.ToString())
+	}
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"errors"
+
+	"../elevTypes/elevator"
+	"../filebackup"
+	"../journal"
+)
+
+// File stores the elevator as backup generations, see filebackup.
+type File struct {
+	fileName string
+	writer   *filebackup.Writer
+}
+
+// NewFile creates a store using the backup file fileName.
+func NewFile(fileName string) *File {
+	return &File{fileName: fileName, writer: filebackup.NewWriter(fileName)}
+}
+
+// Load reads the newest valid backup generation.
+func (s *File) Load() (elevator.Elevator, error) {
+	elev, err := filebackup.Read(s.fileName)
+	if errors.Is(err, filebackup.ErrNoBackup) {
+		return elev, ErrNotFound
+	}
+	return elev, err
+}
+
+// Save writes elev as a new backup generation.
+func (s *File) Save(elev elevator.Elevator) error {
+	return s.writer.Write(elev)
+}
+
+// JournalFile returns the journal next to the backup file.
+func (s *File) JournalFile() string {
+	return journal.FileName(s.fileName)
+}
+
+// Close does nothing, files are closed after every write.
+func (s *File) Close() error {
+	return nil
+}
@@ -0,0 +1,264 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"../elevTypes/elevator"
+	"../filebackup"
+	"../journal"
+)
+
+const (
+	// kvFileNameFormat is formatted with the elevator IO port.
+	kvFileNameFormat string = "logs/elevStore_%d.db"
+	// elevatorKey is the key the elevator is stored under.
+	elevatorKey string = "elevator"
+
+	// size of the record header: checksum, key length and value length
+	kvHeaderSize int = 12
+	// value length marking a deleted key
+	kvTombstone uint32 = 0xffffffff
+	// the file is compacted when it's this many times larger than the live
+	// records, and larger than kvMinCompactSize
+	kvCompactFactor  int64 = 4
+	kvMinCompactSize int64 = 64 * 1024
+)
+
+// KV is a small embedded key-value store in a single file. Every write is
+// appended as a record with a checksum and synced, and the file is compacted
+// when it has grown much larger than the live data. A record cut short by a
+// crash is detected on open and cut off.
+//
+// Record format:
+// | CRC-32 of rest | key length | value length | key | value |
+type KV struct {
+	mu       sync.Mutex
+	fileName string
+	file     *os.File
+	size     int64
+	live     map[string][]byte
+}
+
+// OpenKV opens or creates the store in fileName.
+func OpenKV(fileName string) (*KV, error) {
+	kv := &KV{fileName: fileName, live: make(map[string][]byte)}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	valid := kv.load(data)
+	if valid < int64(len(data)) {
+		log.Printf("Store '%s' has %d bytes of incomplete records, cutting them off\n",
+			fileName, int64(len(data))-valid)
+	}
+
+	kv.file, err = os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.file.Truncate(valid); err != nil {
+		kv.file.Close()
+		return nil, err
+	}
+	if _, err := kv.file.Seek(valid, 0); err != nil {
+		kv.file.Close()
+		return nil, err
+	}
+	kv.size = valid
+	return kv, nil
+}
+
+// load applies all valid records in data and returns the length of the valid
+// part.
+func (kv *KV) load(data []byte) int64 {
+	var off int64
+	for {
+		key, value, n, ok := decodeRecord(data[off:])
+		if !ok {
+			return off
+		}
+		if value == nil {
+			delete(kv.live, key)
+		} else {
+			kv.live[key] = value
+		}
+		off += n
+	}
+}
+
+func encodeRecord(key string, value []byte) []byte {
+	rec := make([]byte, kvHeaderSize+len(key)+len(value))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(key)))
+	if value == nil {
+		binary.LittleEndian.PutUint32(rec[8:], kvTombstone)
+	} else {
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(value)))
+	}
+	copy(rec[kvHeaderSize:], key)
+	copy(rec[kvHeaderSize+len(key):], value)
+	binary.LittleEndian.PutUint32(rec[0:], crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+// decodeRecord decodes the record at the start of data. A nil value means the
+// key is deleted. ok is false if there is no complete, valid record.
+func decodeRecord(data []byte) (key string, value []byte, n int64, ok bool) {
+	if len(data) < kvHeaderSize {
+		return "", nil, 0, false
+	}
+	keyLen := int64(binary.LittleEndian.Uint32(data[4:]))
+	valLen := binary.LittleEndian.Uint32(data[8:])
+	n = int64(kvHeaderSize) + keyLen
+	if valLen != kvTombstone {
+		n += int64(valLen)
+	}
+	if n > int64(len(data)) ||
+		crc32.ChecksumIEEE(data[4:n]) != binary.LittleEndian.Uint32(data[0:]) {
+		return "", nil, 0, false
+	}
+
+	key = string(data[kvHeaderSize : int64(kvHeaderSize)+keyLen])
+	if valLen != kvTombstone {
+		value = make([]byte, valLen)
+		copy(value, data[int64(kvHeaderSize)+keyLen:n])
+	}
+	return key, value, n, true
+}
+
+// Get returns the value of key, and whether it exists.
+func (kv *KV) Get(key string) ([]byte, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	v, ok := kv.live[key]
+	return v, ok
+}
+
+// Put sets key to value.
+func (kv *KV) Put(key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return kv.write(key, value)
+}
+
+// Delete removes key.
+func (kv *KV) Delete(key string) error {
+	return kv.write(key, nil)
+}
+
+func (kv *KV) write(key string, value []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	rec := encodeRecord(key, value)
+	if _, err := kv.file.Write(rec); err != nil {
+		return err
+	}
+	if err := kv.file.Sync(); err != nil {
+		return err
+	}
+	kv.size += int64(len(rec))
+	if value == nil {
+		delete(kv.live, key)
+	} else {
+		kv.live[key] = value
+	}
+
+	if kv.size > kvMinCompactSize && kv.size > kvCompactFactor*kv.liveSize() {
+		return kv.compact()
+	}
+	return nil
+}
+
+func (kv *KV) liveSize() int64 {
+	var size int64
+	for k, v := range kv.live {
+		size += int64(kvHeaderSize + len(k) + len(v))
+	}
+	return size
+}
+
+// compact rewrites the file with only the live records. The new file is
+// written next to the old one and renamed into place, and then its handle
+// replaces the old one, so the store never writes to a file that's no longer
+// on disk. If anything fails the old file is kept. Must be called with kv.mu
+// held.
+func (kv *KV) compact() error {
+	var data []byte
+	for k, v := range kv.live {
+		data = append(data, encodeRecord(k, v)...)
+	}
+
+	tmpName := kv.fileName + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, kv.fileName); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(kv.fileName)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	kv.file.Close()
+	kv.file = tmp
+	kv.size = int64(len(data))
+	return nil
+}
+
+// Load returns the elevator stored in the store.
+func (kv *KV) Load() (elevator.Elevator, error) {
+	data, ok := kv.Get(elevatorKey)
+	if !ok {
+		return elevator.Elevator{}, ErrNotFound
+	}
+	return filebackup.Decode(data)
+}
+
+// Save stores elev in the same versioned format as the backup files.
+func (kv *KV) Save(elev elevator.Elevator) error {
+	data, err := filebackup.Encode(elev)
+	if err != nil {
+		return err
+	}
+	return kv.Put(elevatorKey, data)
+}
+
+// JournalFile returns the journal next to the store file.
+func (kv *KV) JournalFile() string {
+	return journal.FileName(kv.fileName)
+}
+
+// Close closes the store file.
+func (kv *KV) Close() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.file == nil {
+		return errors.New("store already closed")
+	}
+	err := kv.file.Close()
+	kv.file = nil
+	return err
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestKV opens a store in a new temporary directory and returns it with
+// its file name.
+func openTestKV(t *testing.T) (*KV, string) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	kv, err := OpenKV(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv, fileName
+}
+
+func put(t *testing.T, kv *KV, key, value string) {
+	t.Helper()
+	if err := kv.Put(key, []byte(value)); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+}
+
+// reopen closes kv and opens the file again.
+func reopen(t *testing.T, kv *KV, fileName string) *KV {
+	t.Helper()
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	kv, err := OpenKV(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+// expect fails the test unless key has value, or is missing if value is
+// empty.
+func expect(t *testing.T, kv *KV, key, value string) {
+	t.Helper()
+	got, ok := kv.Get(key)
+	switch {
+	case value == "" && ok:
+		t.Errorf("%s is '%s', want it missing", key, got)
+	case value != "" && !bytes.Equal(got, []byte(value)):
+		t.Errorf("%s is '%s' (exists: %v), want '%s'", key, got, ok, value)
+	}
+}
+
+func fileSize(t *testing.T, fileName string) int64 {
+	t.Helper()
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestKVReopen(t *testing.T) {
+	kv, fileName := openTestKV(t)
+	put(t, kv, "a", "1")
+	put(t, kv, "b", "2")
+	put(t, kv, "a", "3")
+	if err := kv.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	kv = reopen(t, kv, fileName)
+	defer kv.Close()
+	expect(t, kv, "a", "3")
+	expect(t, kv, "b", "")
+}
+
+func TestKVTornTail(t *testing.T) {
+	kv, fileName := openTestKV(t)
+	put(t, kv, "a", "1")
+	whole := fileSize(t, fileName)
+	put(t, kv, "b", "a value cut short by a crash")
+	kv.Close()
+
+	// cut the last record in the middle of its value
+	if err := os.Truncate(fileName, fileSize(t, fileName)-5); err != nil {
+		t.Fatal(err)
+	}
+	kv, err := OpenKV(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, kv, "a", "1")
+	expect(t, kv, "b", "")
+	if size := fileSize(t, fileName); size != whole {
+		t.Errorf("file is %d bytes after opening, want the torn record cut off at %d",
+			size, whole)
+	}
+
+	// new records follow the last whole one
+	put(t, kv, "c", "2")
+	kv = reopen(t, kv, fileName)
+	defer kv.Close()
+	expect(t, kv, "a", "1")
+	expect(t, kv, "c", "2")
+}
+
+func TestKVCorruptCRC(t *testing.T) {
+	kv, fileName := openTestKV(t)
+	put(t, kv, "a", "1")
+	put(t, kv, "b", "2")
+	kv.Close()
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// change the value of b without updating its checksum
+	data[len(data)-1] = '9'
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = OpenKV(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	expect(t, kv, "a", "1")
+	expect(t, kv, "b", "")
+	if _, _, _, ok := decodeRecord(data[len(data)-int(kvHeaderSize)-2:]); ok {
+		t.Error("decodeRecord accepted a record with a wrong checksum")
+	}
+}
+
+func TestKVCompact(t *testing.T) {
+	kv, fileName := openTestKV(t)
+	value := string(bytes.Repeat([]byte("x"), 1024))
+	compacted := false
+	var last int64
+	for i := 0; i < 100; i++ {
+		put(t, kv, "a", value)
+		size := fileSize(t, fileName)
+		if size < last {
+			compacted = true
+		}
+		last = size
+	}
+	if !compacted {
+		t.Fatalf("file grew to %d bytes with one live key, want it compacted", last)
+	}
+	if last > kvMinCompactSize {
+		t.Errorf("file is %d bytes after 100 writes of one key, want at most %d",
+			last, kvMinCompactSize)
+	}
+	if _, err := os.Stat(fileName + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left after compaction: %v", err)
+	}
+
+	// a write after compaction must reach the file on disk
+	put(t, kv, "b", "after")
+	kv = reopen(t, kv, fileName)
+	defer kv.Close()
+	expect(t, kv, "a", value)
+	expect(t, kv, "b", "after")
+}
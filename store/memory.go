@@ -0,0 +1,49 @@
+package store
+
+import (
+	"sync"
+
+	"../elevTypes/elevator"
+)
+
+// Memory keeps the elevator in memory. It's meant for tests and simulations
+// where nothing should survive the process.
+type Memory struct {
+	mu    sync.Mutex
+	elev  elevator.Elevator
+	saved bool
+}
+
+// NewMemory creates an empty memory store.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Load returns a copy of the last saved elevator.
+func (s *Memory) Load() (elevator.Elevator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.saved {
+		return elevator.Elevator{}, ErrNotFound
+	}
+	return s.elev.Copy(), nil
+}
+
+// Save keeps a copy of elev.
+func (s *Memory) Save(elev elevator.Elevator) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.elev = elev.Copy()
+	s.saved = true
+	return nil
+}
+
+// JournalFile returns an empty name, nothing is journaled.
+func (s *Memory) JournalFile() string {
+	return ""
+}
+
+// Close does nothing.
+func (s *Memory) Close() error {
+	return nil
+}
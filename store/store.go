@@ -0,0 +1,42 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"../elevTypes/elevator"
+	"../filebackup"
+)
+
+// ErrNotFound is returned by Load when nothing has been saved.
+var ErrNotFound = errors.New("no stored elevator")
+
+// Store persists the elevator state so it can be restored after a crash.
+type Store interface {
+	// Load returns the last saved elevator, or ErrNotFound.
+	Load() (elevator.Elevator, error)
+	// Save persists elev.
+	Save(elev elevator.Elevator) error
+	// JournalFile returns the file the changes between saves are journaled
+	// in, see journal. It's empty for a store that keeps nothing on disk.
+	JournalFile() string
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// Backends is the names accepted by Open.
+var Backends = []string{"file", "kv", "memory"}
+
+// Open creates the store named by backend for the elevator on the given IO
+// port.
+func Open(backend string, port int) (Store, error) {
+	switch backend {
+	case "file":
+		return NewFile(filebackup.FileName(port)), nil
+	case "kv":
+		return OpenKV(fmt.Sprintf(kvFileNameFormat, port))
+	case "memory":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown store backend '%s', must be one of %v", backend, Backends)
+}
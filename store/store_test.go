@@ -0,0 +1,52 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+
+	"../elevTypes/elevator"
+	"../elevTypes/order"
+)
+
+// TestBackends saves and loads an elevator through each store.
+func TestBackends(t *testing.T) {
+	dir := t.TempDir()
+	kv, err := OpenKV(filepath.Join(dir, "elevStore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]Store{
+		"file":   NewFile(filepath.Join(dir, "elevBackup.json")),
+		"kv":     kv,
+		"memory": NewMemory(),
+	}
+
+	for name, s := range stores {
+		if _, err := s.Load(); err != ErrNotFound {
+			t.Errorf("%s: Load from an empty store gave %v, want ErrNotFound", name, err)
+		}
+
+		elev := elevator.NewElevator(4, 3)
+		elev.Floor = 2
+		elev.Orders[3][order.Cab].Status = order.Execute
+		if err := s.Save(elev); err != nil {
+			t.Fatalf("%s: Save: %v", name, err)
+		}
+		// the store keeps its own copy
+		elev.Orders[3][order.Cab].Status = order.Finished
+
+		got, err := s.Load()
+		if err != nil {
+			t.Fatalf("%s: Load: %v", name, err)
+		}
+		if got.Floor != 2 || got.Orders[3][order.Cab].Status != order.Execute {
+			t.Errorf("%s: loaded %s, want the saved elevator", name, got.ToString())
+		}
+		if (s.JournalFile() == "") != (name == "memory") {
+			t.Errorf("%s: journal file is '%s'", name, s.JournalFile())
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("%s: Close: %v", name, err)
+		}
+	}
+}
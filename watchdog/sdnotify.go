@@ -0,0 +1,43 @@
+package watchdog
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// dialNotifySocket connects to the socket systemd passes in $NOTIFY_SOCKET. A
+// name starting with '@' is in the abstract namespace. Any unixgram socket
+// works, so the protocol can be tested without systemd, e.g. with
+//
+//	socat UNIX-RECV:/tmp/notify.sock STDOUT
+//	NOTIFY_SOCKET=/tmp/notify.sock ./heis --wdmode=systemd
+func dialNotifySocket() (*net.UnixConn, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil, errors.New("NOTIFY_SOCKET is not set, not started by systemd?")
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	return net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+}
+
+// systemdInterval returns half the watchdog timeout systemd has configured
+// for this process in $WATCHDOG_USEC, which is how often systemd recommends
+// sending WATCHDOG=1. ok is false if the watchdog isn't enabled for this
+// process.
+func systemdInterval() (interval time.Duration, ok bool) {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+			return 0, false
+		}
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
@@ -0,0 +1,53 @@
+package watchdog
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotify(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "notify.sock")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	t.Setenv("NOTIFY_SOCKET", name)
+	// WATCHDOG=1 is sent every 100ms
+	t.Setenv("WATCHDOG_USEC", "200000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	if err := Setup("systemd", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if interval != 100*time.Millisecond {
+		t.Errorf("feeding every %s, want 100ms", interval)
+	}
+	Ready()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	want := map[string]bool{"READY=1": false, "WATCHDOG=1": false}
+	missing := len(want)
+	sock.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	for missing > 0 {
+		n, err := sock.Read(buf)
+		if err != nil {
+			t.Fatalf("%v, still missing some of %v", err, want)
+		}
+		msg := string(buf[:n])
+		if seen, ok := want[msg]; ok && !seen {
+			want[msg] = true
+			missing--
+		}
+	}
+}
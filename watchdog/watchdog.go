@@ -1,29 +1,160 @@
 package watchdog
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
 	"time"
 
+	"../health"
 	"../network/bcast"
+	"../network/conn"
+)
+
+// Modes is the protocols the watchdog can speak, see Setup.
+var Modes = []string{"udp", "systemd"}
+
+// Exit codes telling the watchdog program whether to restart the process.
+// Other codes, e.g. from log.Fatal or a panic, are treated like ExitRestart.
+const (
+	// ExitStopped means the process was asked to stop and shut down cleanly.
+	// It should not be restarted.
+	ExitStopped int = 0
+	// ExitRestart means the process failed, or couldn't finish shutting down,
+	// and should be restarted.
+	ExitRestart int = 1
+	// ExitUsage means the process was started with invalid flags. Restarting
+	// it won't help.
+	ExitUsage int = 64
 )
 
 const (
 	// How often to send message to watchdog.
 	wdTimerInterval time.Duration = 500 * time.Millisecond
+
+	// How many times to try opening the watchdog socket before giving up.
+	dialAttempts int = 5
+	// How long to wait between each attempt.
+	dialRetryInterval time.Duration = 1 * time.Second
 )
 
 var (
-	wdChan  chan interface{}
-	wdTimer *time.Timer
-	message string
+	mode     string
+	interval time.Duration = wdTimerInterval
+	wdChan   chan interface{}
+	wdTimer  *time.Timer
+	message  string
+
+	// used in udp mode
+	udpConn  net.PacketConn
+	udpPort  int
+	policies bcast.Policies
+
+	// used in systemd mode
+	notifyConn *net.UnixConn
+	status     string
 )
 
-// Setup initializes the broadcaster and timer. Parameter msg is what is sent
-// to the watchdog program.
-func Setup(msg string, port int) {
-	message = msg
-	wdChan = make(chan interface{})
-	wdTimer = time.NewTimer(wdTimerInterval)
-	go bcast.Transmitter(port, wdChan)
+// Setup opens the watchdog socket and initializes the timer. In "udp" mode, msg
+// is broadcast to the watchdog program on port. In "systemd" mode, the
+// sd_notify protocol is used over $NOTIFY_SOCKET, and msg and port are not
+// used. An error is returned if the socket can't be opened. Nothing is sent
+// to the watchdog program before Run is called.
+func Setup(m string, msg string, port int) error {
+	switch m {
+	case "udp":
+		c, err := conn.DialBroadcastUDPRetry(port, dialAttempts, dialRetryInterval)
+		if err != nil {
+			return fmt.Errorf("watchdog on port %d: %w", port, err)
+		}
+		udpConn = c
+		udpPort = port
+		message = msg
+		wdChan = make(chan interface{})
+		// the message is sent again on every feed, so one copy is enough
+		policies = bcast.Policies{bcast.PolicyKey(message): {Copies: 1}}
+
+	case "systemd":
+		c, err := dialNotifySocket()
+		if err != nil {
+			return fmt.Errorf("systemd watchdog: %w", err)
+		}
+		notifyConn = c
+		if d, ok := systemdInterval(); ok && d < interval {
+			interval = d
+		} else if !ok {
+			log.Println("Systemd watchdog is not enabled for this process, " +
+				"only sending status.")
+		}
+		setStatus("Starting")
+
+	default:
+		return fmt.Errorf("unknown watchdog mode '%s', must be one of %v", m, Modes)
+	}
+
+	mode = m
+	wdTimer = time.NewTimer(interval)
+	return nil
+}
+
+// notify sends state to systemd, see sd_notify(3).
+func notify(state string) {
+	if _, err := notifyConn.Write([]byte(state)); err != nil {
+		log.Printf("Could not notify systemd: %v\n", err)
+	}
+}
+
+// setStatus sends the status shown by systemctl status if it has changed.
+func setStatus(s string) {
+	if s != status {
+		status = s
+		notify("STATUS=" + s)
+	}
+}
+
+// Ready tells the watchdog program that startup is done. Only used in
+// systemd mode, where it's needed for services of Type=notify.
+func Ready() {
+	if mode == "systemd" {
+		notify("READY=1")
+		setStatus("Running")
+	}
+}
+
+// Stopping tells the watchdog program that the process is shutting down.
+// Only used in systemd mode.
+func Stopping() {
+	if mode == "systemd" {
+		notify("STOPPING=1")
+		setStatus("Stopping")
+	}
+}
+
+// Run feeds the watchdog until ctx is cancelled, and then closes the socket.
+func Run(ctx context.Context) error {
+	done := make(chan struct{})
+	if mode == "udp" {
+		go func() {
+			defer close(done)
+			bcast.Transmitter(ctx, udpConn, nil, udpPort, os.Getpid(), wdChan, policies)
+		}()
+	} else {
+		close(done)
+		defer notifyConn.Close()
+	}
+
+	for {
+		select {
+		case <-Hungry():
+			Feed()
+		case <-ctx.Done():
+			wdTimer.Stop()
+			<-done
+			return nil
+		}
+	}
 }
 
 // Hungry returns a channel which is filled when timer times out.
@@ -31,8 +162,29 @@ func Hungry() <-chan time.Time {
 	return wdTimer.C
 }
 
-// Feed sends the I'm alive message and restarts the timer.
+// Feed sends the I'm alive message if all components in the health registry
+// are healthy, and restarts the timer. Otherwise the failing components are
+// logged and the message is skipped, so that the watchdog program restarts
+// the process if they don't recover. If the transmitter isn't ready the
+// message is skipped rather than blocking the caller.
 func Feed() {
-	wdChan <- message
-	wdTimer.Reset(wdTimerInterval)
+	wdTimer.Reset(interval)
+	if err := health.Check(); err != nil {
+		log.Printf("Not feeding watchdog: %v\n", err)
+		if mode == "systemd" {
+			setStatus(err.Error())
+		}
+		return
+	}
+
+	if mode == "systemd" {
+		notify("WATCHDOG=1")
+		setStatus("Running")
+		return
+	}
+	select {
+	case wdChan <- message:
+	default:
+		log.Println("Watchdog transmitter busy, skipping message.")
+	}
 }